@@ -0,0 +1,437 @@
+// Package conf parses the NATS server configuration format.
+//
+// The format is a relaxed JSON/YAML like syntax:
+//
+//	# comments start with '#' or '//'
+//	port: 4222
+//	host = "0.0.0.0"
+//
+//	authorization {
+//	  users = [
+//	    {user: alice, password: foo}
+//	  ]
+//	}
+//
+//	include ./cluster.conf
+//
+// Keys and values are separated by ':', '=' or whitespace, entries by
+// newlines, ',' or ';'. Values are maps ({...}), arrays ([...]), quoted
+// strings, booleans (true/false, yes/no, on/off), integers, floats or
+// bare strings. Within a bare value a comment has to follow a blank.
+// Interpreting bare strings such as "1MB" or "2m" is left to the
+// consumer of the parsed map.
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxIncludeDepth guards against include cycles.
+const maxIncludeDepth = 10
+
+// parser is a simple recursive descent parser, it keeps track of the
+// line and column so errors can point at the offending input.
+type parser struct {
+	fp    string // file being parsed, empty when parsing a string
+	data  string
+	pos   int
+	line  int
+	col   int
+	depth int // include depth
+
+	positions Positions // where values start, nil when not wanted
+}
+
+// Parse will return a map of keys to interface{}, although concrete types
+// underly them. The values supported are string, bool, int64, float64,
+// []interface{} and map[string]interface{}.
+func Parse(data string) (map[string]interface{}, error) {
+	p := newParser("", data, 0)
+	return p.parse("")
+}
+
+// ParseFile is a helper to open a file, parse it and return its content.
+// Includes are resolved relative to the directory of the file.
+func ParseFile(fp string) (map[string]interface{}, error) {
+	return parseFile(fp, 0, "", nil)
+}
+
+// ParseFileWithPositions is like ParseFile but also returns where each
+// value starts, so that consumers can point at the offending value when
+// it does not make sense to them.
+func ParseFileWithPositions(fp string) (map[string]interface{}, Positions, error) {
+	positions := make(Positions)
+	m, err := parseFile(fp, 0, "", positions)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, positions, nil
+}
+
+// parseFile parses the file fp, recording positions under path.
+func parseFile(fp string, depth int, path string, positions Positions) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config file: %v", err)
+	}
+	p := newParser(fp, string(data), depth)
+	p.positions = positions
+	return p.parse(path)
+}
+
+func newParser(fp, data string, depth int) *parser {
+	return &parser{fp: fp, data: data, line: 1, col: 1, depth: depth}
+}
+
+func (p *parser) parse(path string) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	if err := p.parseMapBody(m, 0, path); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Pos is a location in the input, File is empty when parsing a string.
+type Pos struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (ps Pos) String() string {
+	if ps.File != "" {
+		return fmt.Sprintf("%s:%d:%d", ps.File, ps.Line, ps.Column)
+	}
+	return fmt.Sprintf("line %d, column %d", ps.Line, ps.Column)
+}
+
+// Positions holds where each value starts, keyed by its path: the keys
+// of the enclosing maps and the indexes of the enclosing arrays.
+type Positions map[string]Pos
+
+// Lookup returns the position of the value at the given path, e.g.
+// Lookup("authorization", "users", "0", "user").
+func (ps Positions) Lookup(path ...string) (Pos, bool) {
+	at, ok := ps[strings.Join(path, ".")]
+	return at, ok
+}
+
+// joinPath appends key to the path of the enclosing value.
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func (p *parser) mark() Pos {
+	return Pos{p.fp, p.line, p.col}
+}
+
+// record remembers where the value at path starts, if asked to.
+func (p *parser) record(path string, at Pos) {
+	if p.positions != nil {
+		p.positions[path] = at
+	}
+}
+
+func (p *parser) errorf(at Pos, format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %s", at, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+func (p *parser) next() byte {
+	if p.eof() {
+		return 0
+	}
+	b := p.data[p.pos]
+	p.pos++
+	if b == '\n' {
+		p.line++
+		p.col = 1
+	} else {
+		p.col++
+	}
+	return b
+}
+
+// atComment reports whether a comment starts at the current position.
+func (p *parser) atComment() bool {
+	if p.peek() == '#' {
+		return true
+	}
+	return strings.HasPrefix(p.data[p.pos:], "//")
+}
+
+func (p *parser) skipComment() {
+	for !p.eof() && p.peek() != '\n' {
+		p.next()
+	}
+}
+
+// skipSpace skips blanks and comments, newlines are only skipped when
+// newlines is true.
+func (p *parser) skipSpace(newlines bool) {
+	for !p.eof() {
+		switch b := p.peek(); {
+		case b == ' ' || b == '\t' || b == '\r':
+			p.next()
+		case b == '\n' && newlines:
+			p.next()
+		case p.atComment():
+			p.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+// parseMapBody parses key/value entries into m until closer is found,
+// closer being 0 for the top level which ends at EOF. path is the path
+// of m itself.
+func (p *parser) parseMapBody(m map[string]interface{}, closer byte, path string) error {
+	for {
+		// Skip empty lines and entry separators.
+		for {
+			p.skipSpace(true)
+			if b := p.peek(); b == ',' || b == ';' {
+				p.next()
+				continue
+			}
+			break
+		}
+		if p.eof() {
+			if closer != 0 {
+				return p.errorf(p.mark(), "unexpected end of file, expected '%c'", closer)
+			}
+			return nil
+		}
+		if p.peek() == closer {
+			p.next()
+			return nil
+		}
+
+		keyPos := p.mark()
+		key, err := p.parseKey()
+		if err != nil {
+			return err
+		}
+		p.skipSpace(false)
+		if b := p.peek(); b == ':' || b == '=' {
+			p.next()
+			p.skipSpace(false)
+		}
+
+		valPos := p.mark()
+		v, err := p.parseValue(joinPath(path, key))
+		if err != nil {
+			return err
+		}
+
+		if strings.ToLower(key) == "include" {
+			if err := p.include(m, v, keyPos, path); err != nil {
+				return err
+			}
+		} else {
+			m[key] = v
+			p.record(joinPath(path, key), valPos)
+		}
+
+		// A value has to be followed by the end of the entry.
+		p.skipSpace(false)
+		switch b := p.peek(); {
+		case p.eof(), b == '\n', b == ',', b == ';':
+		case b == closer && closer != 0:
+		default:
+			return p.errorf(p.mark(), "unexpected %q after value of key %q (at line %d, column %d)",
+				b, key, valPos.Line, valPos.Column)
+		}
+	}
+}
+
+// include parses the referenced file and merges its top level keys into m,
+// path being the path of m.
+func (p *parser) include(m map[string]interface{}, v interface{}, at Pos, path string) error {
+	name, ok := v.(string)
+	if !ok || name == "" {
+		return p.errorf(at, "include expects a file name, got %v", v)
+	}
+	if p.depth >= maxIncludeDepth {
+		return p.errorf(at, "too many nested includes including %q", name)
+	}
+	if !filepath.IsAbs(name) && p.fp != "" {
+		name = filepath.Join(filepath.Dir(p.fp), name)
+	}
+	im, err := parseFile(name, p.depth+1, path, p.positions)
+	if err != nil {
+		return p.errorf(at, "include %q: %v", name, err)
+	}
+	for k, iv := range im {
+		m[k] = iv
+	}
+	return nil
+}
+
+func isKeyChar(b byte) bool {
+	switch {
+	case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9':
+		return true
+	case b == '_' || b == '-' || b == '.' || b == '$':
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseKey() (string, error) {
+	start := p.mark()
+	switch p.peek() {
+	case '"', '\'':
+		return p.parseString()
+	}
+	begin := p.pos
+	for !p.eof() && isKeyChar(p.peek()) {
+		p.next()
+	}
+	if p.pos == begin {
+		return "", p.errorf(start, "expected a key, got %q", p.peek())
+	}
+	return p.data[begin:p.pos], nil
+}
+
+// parseValue parses the value at path.
+func (p *parser) parseValue(path string) (interface{}, error) {
+	start := p.mark()
+	switch p.peek() {
+	case '{':
+		p.next()
+		m := make(map[string]interface{})
+		if err := p.parseMapBody(m, '}', path); err != nil {
+			return nil, err
+		}
+		return m, nil
+	case '[':
+		p.next()
+		return p.parseArray(start, path)
+	case '"', '\'':
+		return p.parseString()
+	}
+
+	// Bare value, runs until the end of the entry.
+	begin := p.pos
+	for !p.eof() {
+		b := p.peek()
+		if b == '\n' || b == ',' || b == ';' || b == '}' || b == ']' {
+			break
+		}
+		// A comment only starts after a blank, so URLs and values such as
+		// passwords can hold '//' and '#'.
+		if p.pos > begin && (b == '#' || b == '/' && strings.HasPrefix(p.data[p.pos:], "//")) {
+			if prev := p.data[p.pos-1]; prev == ' ' || prev == '\t' {
+				break
+			}
+		}
+		p.next()
+	}
+	raw := strings.TrimSpace(p.data[begin:p.pos])
+	if raw == "" {
+		return nil, p.errorf(start, "expected a value")
+	}
+	return convertBare(raw), nil
+}
+
+// convertBare turns an unquoted value into a bool, int64 or float64 when
+// it looks like one, leaving everything else as a string.
+func convertBare(raw string) interface{} {
+	switch strings.ToLower(raw) {
+	case "true", "yes", "on":
+		return true
+	case "false", "no", "off":
+		return false
+	}
+	if i, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return i
+	}
+	if strings.ContainsAny(raw, "0123456789") && !strings.ContainsAny(raw, "xXiInN") {
+		if f, err := strconv.ParseFloat(raw, 64); err == nil {
+			return f
+		}
+	}
+	return raw
+}
+
+func (p *parser) parseArray(start Pos, path string) (interface{}, error) {
+	array := make([]interface{}, 0)
+	for {
+		for {
+			p.skipSpace(true)
+			if p.peek() == ',' {
+				p.next()
+				continue
+			}
+			break
+		}
+		if p.eof() {
+			return nil, p.errorf(start, "unterminated array")
+		}
+		if p.peek() == ']' {
+			p.next()
+			return array, nil
+		}
+		elemPath := joinPath(path, strconv.Itoa(len(array)))
+		elemPos := p.mark()
+		v, err := p.parseValue(elemPath)
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, v)
+		p.record(elemPath, elemPos)
+	}
+}
+
+// parseString parses a double quoted string, which supports the usual
+// escapes, or a single quoted raw string.
+func (p *parser) parseString() (string, error) {
+	start := p.mark()
+	quote := p.next()
+	var sb strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf(start, "unterminated string")
+		}
+		b := p.next()
+		if b == quote {
+			return sb.String(), nil
+		}
+		if b != '\\' || quote == '\'' {
+			sb.WriteByte(b)
+			continue
+		}
+		escPos := p.mark()
+		switch e := p.next(); e {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case '"', '\\', '/':
+			sb.WriteByte(e)
+		default:
+			return "", p.errorf(escPos, "invalid escape character %q", e)
+		}
+	}
+}
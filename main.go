@@ -1,10 +1,15 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 
-	"github.com/nats-io/gnatsd/server"
+	"github.com/impact-eintr/nats-server/server"
 )
 
 var usageStr = `
@@ -12,12 +17,12 @@ Usage: gnatsd [options]
 
 Server Options:
     -a, --addr <host>                Bind to host address (default: 0.0.0.0)
-    -p, --port <port>                Use port for clients (default: 4222)
+    -p, --port <port>                Use port for clients (default: 6430)
     -P, --pid <file>                 File to store PID
     -m, --http_port <port>           Use port for http monitoring
     -ms,--https_port <port>          Use port for https monitoring
     -c, --config <file>              Configuration file
-    -sl,--signal <signal>[=<pid>]    Send signal to gnatsd process (stop, quit, reopen, reload)
+    -sl,--signal <signal>[=<pid>]    Send signal to gnatsd process (stop, quit, reopen, reload, ldm)
 
 Logging Options:
     -l, --log <file>                 File to redirect log output
@@ -53,6 +58,22 @@ Common Options:
         --help_tls                   TLS help
 `
 
+var tlsUsage = `
+TLS Options:
+        --tls                        Enable TLS, do not verify clients (default: false)
+        --tlscert <file>             Server certificate file
+        --tlskey <file>              Private key for server certificate
+        --tlsverify                  Enable TLS, verify client certificates
+        --tlscacert <file>           Client certificate CA for verification
+
+Examples using the test certificates which are self signed for localhost and 127.0.0.1.
+
+    gnatsd --tls --tlscert=./test/configs/certs/server-cert.pem --tlskey=./test/configs/certs/server-key.pem
+
+    gnatsd --tlsverify --tlscert=./test/configs/certs/server-cert.pem --tlskey=./test/configs/certs/server-key.pem \
+           --tlscacert=./test/configs/certs/ca.pem
+`
+
 // usage will print out the flag options for the server.
 func usage() {
 	fmt.Printf("%s\n", usageStr)
@@ -60,13 +81,261 @@ func usage() {
 }
 
 func main() {
+	// Server Options
 	opts := &server.Options{}
 
 	var (
 		showVersion   bool
+		showHelp      bool
 		debugAndTrace bool
 		configFile    string
 		signal        string
 		showTLSHelp   bool
+		routesStr     string
+		tlsVerify     bool
+		tlsCert       string
+		tlsKey        string
+		tlsCaCert     string
 	)
+
+	// Parse errors print the usage to stderr and exit non-zero,
+	// -h/--help prints it to stdout and exits cleanly.
+	flag.CommandLine.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\n", usageStr)
+	}
+
+	// Parse flags
+	flag.IntVar(&opts.Port, "port", 0, "Port to listen on.")
+	flag.IntVar(&opts.Port, "p", 0, "Port to listen on.")
+	flag.StringVar(&opts.Host, "addr", "", "Network host to listen on.")
+	flag.StringVar(&opts.Host, "a", "", "Network host to listen on.")
+	flag.StringVar(&opts.Host, "net", "", "Network host to listen on.")
+	flag.BoolVar(&opts.Debug, "D", false, "Enable Debug logging.")
+	flag.BoolVar(&opts.Debug, "debug", false, "Enable Debug logging.")
+	flag.BoolVar(&opts.Trace, "V", false, "Enable Trace logging.")
+	flag.BoolVar(&opts.Trace, "trace", false, "Enable Trace logging.")
+	flag.BoolVar(&debugAndTrace, "DV", false, "Enable Debug and Trace logging.")
+	flag.BoolVar(&opts.Logtime, "T", true, "Timestamp log entries.")
+	flag.BoolVar(&opts.Logtime, "logtime", true, "Timestamp log entries.")
+	flag.StringVar(&opts.Username, "user", "", "Username required for connection.")
+	flag.StringVar(&opts.Password, "pass", "", "Password required for connection.")
+	flag.StringVar(&opts.Authorization, "auth", "", "Authorization token required for connection.")
+	flag.IntVar(&opts.HTTPPort, "m", 0, "HTTP Port for /varz, /connz endpoints.")
+	flag.IntVar(&opts.HTTPPort, "http_port", 0, "HTTP Port for /varz, /connz endpoints.")
+	flag.IntVar(&opts.HTTPSPort, "ms", 0, "HTTPS Port for /varz, /connz endpoints.")
+	flag.IntVar(&opts.HTTPSPort, "https_port", 0, "HTTPS Port for /varz, /connz endpoints.")
+	flag.StringVar(&configFile, "c", "", "Configuration file.")
+	flag.StringVar(&configFile, "config", "", "Configuration file.")
+	flag.StringVar(&signal, "sl", "", "Send signal to gnatsd process (stop, quit, reopen, reload, ldm)")
+	flag.StringVar(&signal, "signal", "", "Send signal to gnatsd process (stop, quit, reopen, reload, ldm)")
+	flag.StringVar(&opts.PidFile, "P", "", "File to store process pid.")
+	flag.StringVar(&opts.PidFile, "pid", "", "File to store process pid.")
+	flag.StringVar(&opts.LogFile, "l", "", "File to store logging output.")
+	flag.StringVar(&opts.LogFile, "log", "", "File to store logging output.")
+	flag.BoolVar(&opts.Syslog, "s", false, "Enable syslog as log method.")
+	flag.BoolVar(&opts.Syslog, "syslog", false, "Enable syslog as log method.")
+	flag.StringVar(&opts.RemoteSyslog, "r", "", "Syslog server addr (udp://localhost:514).")
+	flag.StringVar(&opts.RemoteSyslog, "remote_syslog", "", "Syslog server addr (udp://localhost:514).")
+	flag.BoolVar(&showVersion, "version", false, "Print version information.")
+	flag.BoolVar(&showVersion, "v", false, "Print version information.")
+	flag.BoolVar(&showHelp, "h", false, "Show this message.")
+	flag.BoolVar(&showHelp, "help", false, "Show this message.")
+	flag.IntVar(&opts.ProfPort, "profile", 0, "Profiling HTTP port")
+	flag.StringVar(&routesStr, "routes", "", "Routes to actively solicit a connection.")
+	flag.StringVar(&opts.Cluster.ListenStr, "cluster", "", "Cluster url from which members can solicit routes.")
+	flag.StringVar(&opts.Cluster.ListenStr, "cluster_listen", "", "Cluster url from which members can solicit routes.")
+	flag.BoolVar(&opts.Cluster.NoAdvertise, "no_advertise", false, "Advertise known cluster IPs to clients.")
+	flag.IntVar(&opts.Cluster.ConnectRetries, "connect_retries", 0, "For implicit routes, number of connect retries")
+	flag.BoolVar(&showTLSHelp, "help_tls", false, "TLS help.")
+	flag.BoolVar(&opts.TLS, "tls", false, "Enable TLS.")
+	flag.BoolVar(&tlsVerify, "tlsverify", false, "Enable TLS with client verification.")
+	flag.StringVar(&tlsCert, "tlscert", "", "Server certificate file.")
+	flag.StringVar(&tlsKey, "tlskey", "", "Private key for server certificate.")
+	flag.StringVar(&tlsCaCert, "tlscacert", "", "Client certificate CA for verification.")
+
+	flag.Parse()
+
+	// -T/--logtime defaults to true, remember whether it was given so that
+	// it only overrides the config file when it was.
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "T" || f.Name == "logtime" {
+			opts.LogtimeSet = true
+		}
+	})
+
+	// Process args looking for non-flag options,
+	// 'version' and 'help' only for now
+	for _, arg := range flag.Args() {
+		switch strings.ToLower(arg) {
+		case "version":
+			showVersion = true
+		case "help":
+			showHelp = true
+		default:
+			server.PrintAndDie(fmt.Sprintf("unrecognized command: %q", arg))
+		}
+	}
+
+	// Show version and exit
+	if showVersion {
+		fmt.Printf("nats-server version %s\n", server.VERSION)
+		os.Exit(0)
+	}
+
+	if showHelp {
+		usage()
+	}
+
+	if showTLSHelp {
+		fmt.Printf("%s\n", tlsUsage)
+		os.Exit(0)
+	}
+
+	// One flag can set multiple options.
+	if debugAndTrace {
+		opts.Trace, opts.Debug = true, true
+	}
+
+	// Configure TLS based on any present flags
+	if err := configureTLS(opts, tlsVerify, tlsCert, tlsKey, tlsCaCert); err != nil {
+		server.PrintAndDie(err.Error())
+	}
+
+	// Configure cluster opts if explicitly set via flags.
+	if err := configureClusterOpts(opts, routesStr); err != nil {
+		server.PrintAndDie(err.Error())
+	}
+
+	// Snapshot flag options, they keep precedence on config reload.
+	flagOpts := *opts
+	server.FlagSnapshot = &flagOpts
+
+	// Parse config if given, command line options override the file.
+	if configFile != "" {
+		fileOpts, err := server.ProcessConfigFile(configFile)
+		if err != nil {
+			server.PrintAndDie(err.Error())
+		}
+		opts = server.MergeOptions(fileOpts, opts)
+	}
+
+	// Solicited routes, from the flags or the file, need a cluster port.
+	if len(opts.Routes) > 0 && opts.Cluster.Port == 0 {
+		server.PrintAndDie("Solicited routes require cluster capabilities, e.g. --cluster")
+	}
+
+	// Process signal, the pid file may come from the config file.
+	if signal != "" {
+		if err := processSignal(signal, opts.PidFile); err != nil {
+			server.PrintAndDie(err.Error())
+		}
+		os.Exit(0)
+	}
+
+	// Create the server with appropriate options.
+	s := server.New(opts)
+
+	// Start things up. Block here until done.
+	if err := server.Run(s); err != nil {
+		server.PrintAndDie(err.Error())
+	}
+}
+
+// processSignal sends the signal given as <signal>[=<pid>] to a running
+// server, falling back to the pid file when no pid is given.
+func processSignal(signal, pidFile string) error {
+	var pid string
+	if l := strings.SplitN(signal, "=", 2); len(l) == 2 {
+		signal, pid = l[0], l[1]
+	}
+	if pid == "" {
+		pid = pidFile
+	}
+	if pid == "" {
+		return fmt.Errorf("%s: no pid given, use %s=<pid> or -P <pid file>", signal, signal)
+	}
+	return server.ProcessSignal(server.Command(signal), pid)
+}
+
+// configureTLS builds the TLS configuration from the --tls* flags.
+func configureTLS(opts *server.Options, tlsVerify bool, tlsCert, tlsKey, tlsCaCert string) error {
+	// If no trigger flags, ignore the others
+	if !opts.TLS && !tlsVerify {
+		return nil
+	}
+	if tlsCert == "" {
+		return fmt.Errorf("TLS Server certificate must be present and valid")
+	}
+	if tlsKey == "" {
+		return fmt.Errorf("TLS Server private key must be present and valid")
+	}
+
+	tc := server.TLSConfigOpts{}
+	tc.CertFile = tlsCert
+	tc.KeyFile = tlsKey
+	tc.CaFile = tlsCaCert
+	tc.Verify = tlsVerify
+
+	var err error
+	if opts.TLSConfig, err = server.GenTLSConfig(&tc); err != nil {
+		return err
+	}
+	opts.TLS = true
+	return nil
+}
+
+// configureClusterOpts parses the --cluster url and the --routes list.
+func configureClusterOpts(opts *server.Options, routesStr string) error {
+	if routesStr != "" {
+		routes, err := parseRoutes(routesStr)
+		if err != nil {
+			return err
+		}
+		opts.Routes = routes
+	}
+
+	if opts.Cluster.ListenStr == "" {
+		return nil
+	}
+
+	clusterURL, err := url.Parse(opts.Cluster.ListenStr)
+	if err != nil {
+		return fmt.Errorf("Error parsing cluster url %q: %v", opts.Cluster.ListenStr, err)
+	}
+	h, p, err := net.SplitHostPort(clusterURL.Host)
+	if err != nil {
+		return fmt.Errorf("Error parsing cluster address %q: %v", clusterURL.Host, err)
+	}
+	opts.Cluster.Host = h
+	if opts.Cluster.Port, err = strconv.Atoi(p); err != nil {
+		return fmt.Errorf("Error parsing cluster port %q: %v", p, err)
+	}
+
+	user := clusterURL.User
+	if user != nil {
+		pass, hasPassword := user.Password()
+		if !hasPassword {
+			return fmt.Errorf("Expected cluster password to be set")
+		}
+		opts.Cluster.Password = pass
+		opts.Cluster.Username = user.Username()
+	}
+	return nil
+}
+
+// parseRoutes parses a comma separated list of route urls.
+func parseRoutes(routesStr string) ([]*url.URL, error) {
+	var routes []*url.URL
+	for _, r := range strings.Split(routesStr, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		u, err := url.Parse(r)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("Error parsing route url %q", r)
+		}
+		routes = append(routes, u)
+	}
+	return routes, nil
 }
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"strings"
 
 	"golang.org/x/crypto/bcrypt"
@@ -22,25 +23,63 @@ func (u *User) clone() *User {
 	return clone
 }
 
+// Permissions are the allowed subjects on a per
+// publish or subscribe basis.
 type Permissions struct {
-	Publish   []string `json:"publish"`
-	Subscribe []string `json:"subscribe"`
+	Publish   *SubjectPermission `json:"publish"`
+	Subscribe *SubjectPermission `json:"subscribe"`
 }
 
-func (p *Permissions) clone() *Permissions {
+// SubjectPermission is an individual allow and deny list of subjects,
+// a subject matching the deny list is refused even if it is allowed.
+// An empty allow list means everything not denied is allowed.
+type SubjectPermission struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// UnmarshalJSON accepts either {"allow": [...], "deny": [...]} or a plain
+// array of subjects, the latter being the older allow-only form.
+func (p *SubjectPermission) UnmarshalJSON(data []byte) error {
+	var allow []string
+	if err := json.Unmarshal(data, &allow); err == nil {
+		p.Allow = allow
+		p.Deny = nil
+		return nil
+	}
+	// 用别名类型避免递归调用UnmarshalJSON
+	type subjectPermission SubjectPermission
+	var sp subjectPermission
+	if err := json.Unmarshal(data, &sp); err != nil {
+		return err
+	}
+	*p = SubjectPermission(sp)
+	return nil
+}
+
+func (p *SubjectPermission) clone() *SubjectPermission {
 	if p == nil {
 		return nil
 	}
-	clone := &Permissions{}
-	if p.Publish != nil {
-		clone.Publish = make([]string, len(p.Publish))
-		copy(clone.Publish, p.Publish)
+	clone := &SubjectPermission{}
+	if p.Allow != nil {
+		clone.Allow = make([]string, len(p.Allow))
+		copy(clone.Allow, p.Allow)
+	}
+	if p.Deny != nil {
+		clone.Deny = make([]string, len(p.Deny))
+		copy(clone.Deny, p.Deny)
 	}
+	return clone
+}
 
-	if p.Subscribe != nil {
-		clone.Subscribe = make([]string, len(p.Subscribe))
-		copy(clone.Subscribe, p.Subscribe)
+func (p *Permissions) clone() *Permissions {
+	if p == nil {
+		return nil
 	}
+	clone := &Permissions{}
+	clone.Publish = p.Publish.clone()
+	clone.Subscribe = p.Subscribe.clone()
 	return clone
 }
 
@@ -52,6 +91,10 @@ func (s *Server) configureAuthorization() {
 	// Snapshot server options
 	opts := s.getOpts()
 
+	// Always start from scratch, on reload the previous users must not
+	// survive a switch to a single user or token.
+	s.users = nil
+
 	// Check for mutiple users first
 	// This just checks and sets up the user map if we have multiple users(多租户).
 	if opts.Users != nil {
@@ -63,7 +106,6 @@ func (s *Server) configureAuthorization() {
 	} else if opts.Username != "" || opts.Authorization != "" {
 		s.info.AuthRequired = true
 	} else {
-		s.users = nil
 		s.info.AuthRequired = false
 	}
 }
@@ -84,12 +126,22 @@ func (s *Server) checkAuthorization(c *client) bool {
 func (s *Server) isClientAuthorized(c *client) bool {
 	opts := s.getOpts()
 
-	if s.users != nil {
-		user, ok := s.users[c.opts.Username]
+	// Snapshot the users, a reload may swap them.
+	s.mu.Lock()
+	users := s.users
+	s.mu.Unlock()
+
+	// Snapshot the client credentials.
+	c.mu.Lock()
+	copts := c.opts
+	c.mu.Unlock()
+
+	if users != nil {
+		user, ok := users[copts.Username]
 		if !ok {
 			return false
 		}
-		ok = comparePasswords(user.Password, c.opts.Password)
+		ok = comparePasswords(user.Password, copts.Password)
 		// If we are authorized, register the user which will properly
 		// setup any permissions for pub/sub authorizatio
 		if ok {
@@ -97,12 +149,12 @@ func (s *Server) isClientAuthorized(c *client) bool {
 		}
 		return ok
 	} else if opts.Authorization != "" {
-		return comparePasswords(opts.Authorization, c.opts.Authorization)
+		return comparePasswords(opts.Authorization, copts.Authorization)
 	} else if opts.Username != "" {
-		if opts.Username != c.opts.Username {
+		if opts.Username != copts.Username {
 			return false
 		}
-		return comparePasswords(opts.Password, c.opts.Password)
+		return comparePasswords(opts.Password, copts.Password)
 	}
 	return true
 
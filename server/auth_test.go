@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSubjectPermissionUnmarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		js       string
+		expected SubjectPermission
+	}{
+		{`["foo","bar.>"]`, SubjectPermission{Allow: []string{"foo", "bar.>"}}},
+		{`{"allow":["orders.>"],"deny":["orders.admin.>"]}`,
+			SubjectPermission{Allow: []string{"orders.>"}, Deny: []string{"orders.admin.>"}}},
+		{`{"deny":["foo"]}`, SubjectPermission{Deny: []string{"foo"}}},
+	} {
+		var p Permissions
+		if err := json.Unmarshal([]byte(`{"publish":`+tc.js+`}`), &p); err != nil {
+			t.Fatalf("Could not unmarshal %s: %v", tc.js, err)
+		}
+		if p.Publish == nil || !reflect.DeepEqual(*p.Publish, tc.expected) {
+			t.Fatalf("Unmarshal %s: expected %+v, got %+v", tc.js, tc.expected, p.Publish)
+		}
+	}
+	var sp SubjectPermission
+	if err := json.Unmarshal([]byte(`"foo"`), &sp); err == nil {
+		t.Fatal("Expected an error unmarshaling a plain string")
+	}
+}
+
+func TestUserCloneDeepCopiesPermissions(t *testing.T) {
+	u := &User{Username: "alice", Password: "pwd", Permissions: &Permissions{
+		Publish:   &SubjectPermission{Allow: []string{"foo"}, Deny: []string{"foo.bar"}},
+		Subscribe: &SubjectPermission{Allow: []string{"baz"}, Deny: []string{"baz.qux"}},
+	}}
+	clone := u.clone()
+	if !reflect.DeepEqual(u, clone) {
+		t.Fatalf("Expected %+v, got %+v", u, clone)
+	}
+
+	clone.Permissions.Publish.Allow[0] = "x"
+	clone.Permissions.Publish.Deny[0] = "x"
+	clone.Permissions.Subscribe.Allow[0] = "x"
+	clone.Permissions.Subscribe.Deny[0] = "x"
+	p := u.Permissions
+	if p.Publish.Allow[0] != "foo" || p.Publish.Deny[0] != "foo.bar" ||
+		p.Subscribe.Allow[0] != "baz" || p.Subscribe.Deny[0] != "baz.qux" {
+		t.Fatalf("Expected the original permissions to be unchanged, got %+v %+v", p.Publish, p.Subscribe)
+	}
+
+	if (*User)(nil).clone() != nil {
+		t.Fatal("Expected a nil clone for a nil user")
+	}
+}
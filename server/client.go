@@ -31,6 +31,19 @@ const (
 	maxBufSize   = 65536
 )
 
+const (
+	// Bound on the number of publish permission results kept per client.
+	maxPermCacheSize = 32
+
+	// Scratch buffer size for the processMsg() calls.
+	msgScratchSize = 512
+	msgHeadProto   = "MSG "
+
+	// Per-client cache of Sublist results, see readCache.
+	maxResultCacheSize = 512
+	pruneSize          = 16
+)
+
 type subscription struct {
 	client  *client
 	subject []byte // 订阅主题
@@ -73,11 +86,13 @@ type client struct {
 	perms *permissions
 	cache readCache
 
+	msgb [msgScratchSize]byte // 构造MSG协议头的缓冲区
 	pcd  map[*client]struct{}
 	atmr *time.Timer
 	ptmr *time.Timer
 	pout int
 	wfc  int
+	pb   int // 自上次flush以来缓冲的待发送字节数
 
 	last time.Time
 	// 这里client继承了协议解析状态机状态"parseState"。
@@ -92,10 +107,13 @@ type client struct {
 }
 
 // 实际上就是一个保持了订阅主题和发布主题的列表
+// nil的allow列表表示不做限制，deny列表总是优先
 type permissions struct {
-	sub    *Sublist
-	pub    *Sublist
-	pcache map[string]bool
+	sub     *Sublist
+	pub     *Sublist
+	subDeny *Sublist
+	pubDeny *Sublist
+	pcache  map[string]bool
 }
 
 // Represent(代表) client cooleans with bitmask
@@ -140,6 +158,53 @@ type readCache struct {
 	subs    int
 }
 
+func (c *client) String() (id string) {
+	return c.ncs
+}
+
+// initClient sets up the per-connection state. Lock is held on entry.
+func (c *client) initClient() {
+	s := c.srv
+	c.cid = atomic.AddUint64(&s.gcid, 1)
+	c.bw = bufio.NewWriterSize(c.nc, startBufSize)
+	c.subs = make(map[string]*subscription)
+	c.debug = (atomic.LoadInt32(&c.srv.logging.debug) != 0)
+	c.trace = (atomic.LoadInt32(&c.srv.logging.trace) != 0)
+
+	// This is a scratch buffer used for processMsg()
+	// The msg header starts with "MSG ",
+	// in bytes that is [77 83 71 32].
+	c.msgb = [msgScratchSize]byte{77, 83, 71, 32}
+
+	// This is to track pending clients that have data to be flushed
+	// after we process inbound msgs from our own connection.
+	c.pcd = make(map[*client]struct{})
+
+	// snapshot the string version of the connection
+	conn := "-"
+	if ip, ok := c.nc.(*net.TCPConn); ok {
+		addr := ip.RemoteAddr().(*net.TCPAddr)
+		conn = fmt.Sprintf("%s:%d", addr.IP, addr.Port)
+	}
+
+	switch c.typ {
+	case CLIENT:
+		c.ncs = fmt.Sprintf("%s - cid:%d", conn, c.cid)
+	case ROUTER:
+		c.ncs = fmt.Sprintf("%s - rid:%d", conn, c.cid)
+	}
+}
+
+func (c *client) typeString() string {
+	switch c.typ {
+	case CLIENT:
+		return "Client"
+	case ROUTER:
+		return "Router"
+	}
+	return "Unknown Type"
+}
+
 func (c *client) readLoop() {
 	// Grab the connection off the client, it will be cleared on a close.
 	// We check for that after the loop, but want to avoid a nil dereference
@@ -208,11 +273,17 @@ func (c *client) readLoop() {
 				err := cp.bw.Flush()
 				cp.nc.SetWriteDeadline(time.Time{})
 				if err != nil {
-					c.Debugf("Error flushing: %v", err)
 					cp.mu.Unlock()
-					cp.closeConnection()
+					if ne, ok := err.(net.Error); ok && ne.Timeout() {
+						// Missed the WriteDeadline, the client is not keeping up.
+						cp.slowConsumer(nil)
+					} else {
+						c.Debugf("Error flushing: %v", err)
+						cp.closeConnection()
+					}
 					cp.mu.Lock()
 				} else {
+					cp.pb = 0
 					// Update outbound last activity.
 					cp.last = last
 					// Check if we should tune(调整) the buffer.
@@ -264,8 +335,47 @@ func (c *client) setPingTimer() {
 	c.ptmr = time.AfterFunc(d, c.processPingTimer)
 }
 
+// processPingTimer 由ptmr定时触发，服务端主动发送PING，
+// 未收到PONG的PING数量超过MaxPingsOut时认为连接已失效。
 func (c *client) processPingTimer() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ptmr = nil
+	// Check if connection is still opened
+	if c.nc == nil {
+		return
+	}
+
+	c.Debugf("%s Ping Timer", c.typeString())
 
+	// Check for violation
+	c.pout++
+	if c.pout > c.srv.getOpts().MaxPingsOut {
+		c.Noticef("Stale %s Connection - Closing", c.typeString())
+		c.traceOutOp("-ERR", []byte(ErrStaleConnection.Error()))
+		c.sendProto([]byte(fmt.Sprintf("-ERR '%s'\r\n", ErrStaleConnection.Error())), true)
+		// The readLoop will notice the closed socket and do the cleanup.
+		c.clearConnection()
+		return
+	}
+
+	c.traceOutOp("PING", nil)
+
+	// Send PING
+	err := c.sendProto([]byte("PING\r\n"), true)
+	if err != nil {
+		c.Debugf("Error on %s Ping Flush, error %s", c.typeString(), err)
+		c.clearConnection()
+	} else {
+		// Reset to fire again if all OK.
+		c.setPingTimer()
+	}
+}
+
+func (c *client) maxPayloadViolation(sz int, max int64) {
+	c.Errorf("%s: %d vs %d", ErrMaxPayload.Error(), sz, max)
+	c.sendErr("Maximum Payload Violation")
+	c.closeConnection()
 }
 
 func (c *client) maxConnExceeded() {
@@ -274,8 +384,142 @@ func (c *client) maxConnExceeded() {
 	c.closeConnection()
 }
 
+// Lock should be held
+func (c *client) setAuthTimer(d time.Duration) {
+	c.atmr = time.AfterFunc(d, func() { c.authTimeout() })
+}
+
+// Lock should be held
+func (c *client) clearAuthTimer() bool {
+	if c.atmr == nil {
+		return true
+	}
+	stopped := c.atmr.Stop()
+	c.atmr = nil
+	return stopped
+}
+
+// isAuthTimerSet returns true while we are still waiting for CONNECT.
+func (c *client) isAuthTimerSet() bool {
+	c.mu.Lock()
+	isSet := c.atmr != nil
+	c.mu.Unlock()
+	return isSet
+}
+
+// Lock should be held
+func (c *client) clearPingTimer() {
+	if c.ptmr == nil {
+		return
+	}
+	c.ptmr.Stop()
+	c.ptmr = nil
+}
+
+// Lock should be held
+func (c *client) clearConnection() {
+	if c.nc == nil {
+		return
+	}
+	// With TLS, Close() is sending an alert (that is doing a write).
+	// Need to set a deadline otherwise the server could block there
+	// if the peer is not reading from socket.
+	c.nc.SetWriteDeadline(time.Now().Add(c.srv.getOpts().WriteDeadline))
+	if c.bw != nil {
+		c.bw.Flush()
+	}
+	c.nc.Close()
+	c.nc.SetWriteDeadline(time.Time{})
+}
+
+// closeConnection 关闭连接，并清理这个连接在Server上留下的所有状态：
+// 定时器、注册信息、订阅，以及路由的重连。
 func (c *client) closeConnection() {
+	c.mu.Lock()
+	if c.nc == nil {
+		c.mu.Unlock()
+		return
+	}
+
+	c.Debugf("%s connection closed", c.typeString())
+
+	c.clearAuthTimer()
+	c.clearPingTimer()
+	c.clearConnection()
+	c.nc = nil
+
+	// Snapshot for use.
+	subs := make([]*subscription, 0, len(c.subs))
+	for _, sub := range c.subs {
+		subs = append(subs, sub)
+	}
+	srv := c.srv
+
+	var (
+		routeClosed   bool
+		retryImplicit bool
+	)
+	if c.route != nil {
+		routeClosed = c.route.closed
+		if !routeClosed {
+			retryImplicit = c.route.retry
+		}
+	}
+
+	c.mu.Unlock()
+
+	if srv != nil {
+		// Unregister
+		srv.removeClient(c)
+
+		// Remove clients subscriptions.
+		for _, sub := range subs {
+			srv.sl.Remove(sub)
+			// Forward on unsubscribes if we are not
+			// a router ourselves.
+			if c.typ != ROUTER {
+				srv.broadcastUnSubscribe(sub)
+			}
+		}
+	}
+
+	// Don't reconnect routes that are being closed.
+	if routeClosed {
+		return
+	}
 
+	// Check for a solicited route. If it was, start up a reconnect unless
+	// we are already connected to the other end.
+	if c.isSolicitedRoute() || retryImplicit {
+		// Capture these under lock
+		c.mu.Lock()
+		rid := c.route.remoteID
+		rtype := c.route.routeType
+		rurl := c.route.url
+		c.mu.Unlock()
+
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		// It is possible that the server is being shutdown.
+		// If so, don't try to reconnect
+		if !srv.running {
+			return
+		}
+
+		if rid != "" && srv.remotes[rid] != nil {
+			srv.Debugf("Not attempting reconnect for solicited route, already connected to \"%s\"", rid)
+			return
+		} else if rid == srv.info.ID {
+			srv.Debugf("Detected route to self, ignoring \"%s\"", rurl)
+			return
+		} else if rtype != Implicit || retryImplicit {
+			srv.Debugf("Attempting reconnect for solicited route \"%s\"", rurl)
+			// Keep track of this go-routine so we can wait for it on
+			// server shutdown.
+			srv.startGoRoutine(func() { srv.reConnectToRoute(rurl, rtype) })
+		}
+	}
 }
 
 func (c *client) processConnect(arg []byte) error {
@@ -284,7 +528,15 @@ func (c *client) processConnect(arg []byte) error {
 	c.mu.Lock()
 	// if we can't stop the timer because the callback is in progress...
 	if !c.clearAuthTimer() {
-		// TODO
+		// wait for it to finish and handle sending the failure back to
+		// the client.
+		for c.nc != nil {
+			c.mu.Unlock()
+			time.Sleep(25 * time.Millisecond)
+			c.mu.Lock()
+		}
+		c.mu.Unlock()
+		return nil
 	}
 	c.last = time.Now()
 	typ := c.typ
@@ -340,6 +592,16 @@ func (c *client) processConnect(arg []byte) error {
 
 }
 
+func (c *client) processErr(errStr string) {
+	switch c.typ {
+	case CLIENT:
+		c.Errorf("Client Error %s", errStr)
+	case ROUTER:
+		c.Errorf("Route Error %s", errStr)
+	}
+	c.closeConnection()
+}
+
 // Process the infomation message from Clients and other Routes
 func (c *client) processInfo(arg []byte) error {
 	info := Info{}
@@ -380,6 +642,12 @@ func (c *client) processSub(argo []byte) (err error) {
 		return fmt.Errorf("processSub Parse Error: %s", arg)
 	}
 
+	// Reject bad subjects before they make it into the Sublist.
+	if !IsValidSubject(string(sub.subject)) {
+		c.sendErr("Invalid Subject")
+		return nil
+	}
+
 	shouldForward := false
 
 	c.mu.Lock()
@@ -424,6 +692,272 @@ func (c *client) processSub(argo []byte) (err error) {
 	return nil
 }
 
+// canSubscribe determines if the client is authorized to subscribe to the
+// given subject. A wildcard subscription is only allowed when it is a subset
+// of one of the permitted subjects, e.g. foo.bar.* under foo.>, and is
+// refused when it falls entirely within a denied subject.
+// Lock should be held.
+func (c *client) canSubscribe(subject []byte) bool {
+	if c.perms == nil {
+		return true
+	}
+	subj := string(subject)
+	allowed := c.perms.sub == nil || hasSubsetMatch(c.perms.sub, subj)
+	if allowed && c.perms.subDeny != nil {
+		allowed = !hasSubsetMatch(c.perms.subDeny, subj)
+	}
+	return allowed
+}
+
+// hasSubsetMatch reports whether subject is a subset of any subject in sl.
+func hasSubsetMatch(sl *Sublist, subject string) bool {
+	// Match treats wildcards in subject as plain tokens, so the result may
+	// contain entries that are broader than subject, filter those out.
+	r := sl.Match(subject)
+	for _, sub := range r.psubs {
+		if SubjectIsSubsetMatch(subject, string(sub.subject)) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliveryDenied checks a message subject against the subscribe deny list.
+// A wildcard subscription such as orders.> may still overlap a denied
+// subject like orders.admin.>, those messages are dropped on delivery.
+// Lock should be held.
+func (c *client) deliveryDenied(subject []byte) bool {
+	if c.perms == nil || c.perms.subDeny == nil {
+		return false
+	}
+	r := c.perms.subDeny.Match(string(subject))
+	return len(r.psubs) > 0
+}
+
+// pubAllowed checks the publish permissions of the client, results are
+// memoised in pcache which is pruned once it grows past maxPermCacheSize.
+func (c *client) pubAllowed(subject []byte) bool {
+	c.mu.Lock()
+	perms := c.perms
+	c.mu.Unlock()
+
+	if perms == nil {
+		return true
+	}
+	allowed, ok := perms.pcache[string(subject)]
+	if ok {
+		return allowed
+	}
+	allowed = true
+	if perms.pub != nil {
+		r := perms.pub.Match(string(subject))
+		allowed = len(r.psubs) > 0
+	}
+	// Deny always wins.
+	if allowed && perms.pubDeny != nil {
+		r := perms.pubDeny.Match(string(subject))
+		allowed = len(r.psubs) == 0
+	}
+	perms.pcache[string(subject)] = allowed
+
+	// Prune if needed.
+	if len(perms.pcache) > maxPermCacheSize {
+		// Prune the permissions cache. Keeps us from unbounded growth.
+		n := 0
+		for subj := range perms.pcache {
+			delete(perms.pcache, subj)
+			if n++; n > pruneSize {
+				break
+			}
+		}
+	}
+	return allowed
+}
+
+func (c *client) pubPermissionViolation(subject []byte) {
+	c.sendErr(fmt.Sprintf("Permissions Violation for Publish to %q", subject))
+	c.Errorf("Publish Violation - User %q, Subject %q", c.opts.Username, subject)
+}
+
+// unsubscribe removes the subscription from the client and the Sublist.
+func (c *client) unsubscribe(sub *subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sub.max > 0 && sub.nm < sub.max {
+		c.Debugf(
+			"Deferring actual UNSUB(%s): %d max, %d received\n",
+			string(sub.subject), sub.max, sub.nm)
+		return
+	}
+	c.traceOp("<-> %s", "DELSUB", sub.sid)
+	delete(c.subs, string(sub.sid))
+	if c.srv != nil {
+		c.srv.sl.Remove(sub)
+	}
+}
+
+// processUnsub handles UNSUB <sid> [max_msgs]. Without max_msgs the
+// subscription is removed right away, otherwise it is kept until it has
+// delivered max_msgs messages (see deliverMsg).
+func (c *client) processUnsub(arg []byte) error {
+	c.traceInOp("UNSUB", arg)
+	args := splitArg(arg)
+	var sid []byte
+	max := -1
+
+	switch len(args) {
+	case 1:
+		sid = args[0]
+	case 2:
+		sid = args[0]
+		max = parseSize(args[1])
+	default:
+		return fmt.Errorf("processUnsub Parse Error: '%s'", arg)
+	}
+
+	// Indicate activity.
+	c.cache.subs += 1
+
+	var sub *subscription
+
+	unsub := false
+	shouldForward := false
+	ok := false
+
+	c.mu.Lock()
+	if sub, ok = c.subs[string(sid)]; ok {
+		if max > 0 {
+			sub.max = int64(max)
+		} else {
+			// Clear it here to override
+			sub.max = 0
+		}
+		unsub = true
+		shouldForward = c.typ != ROUTER && c.srv != nil
+	}
+	c.mu.Unlock()
+
+	if unsub {
+		c.unsubscribe(sub)
+	}
+	if shouldForward {
+		c.srv.broadcastUnSubscribe(sub)
+	}
+	if c.opts.Verbose {
+		c.sendOK()
+	}
+
+	return nil
+}
+
+// processPub parses the arguments of a PUB protocol line, the payload
+// itself is consumed by the parser afterwards.
+func (c *client) processPub(arg []byte) error {
+	c.traceInOp("PUB", arg)
+
+	// Unroll splitArgs to avoid runtime/heap issues
+	a := [MAX_PUB_ARGS][]byte{}
+	args := a[:0]
+	start := -1
+	for i, b := range arg {
+		switch b {
+		case ' ', '\t':
+			if start >= 0 {
+				args = append(args, arg[start:i])
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		args = append(args, arg[start:])
+	}
+
+	// PUB <subject> [reply-to] <#bytes>
+	switch len(args) {
+	case 2:
+		c.pa.subject = args[0]
+		c.pa.reply = nil
+		c.pa.size = parseSize(args[1])
+		c.pa.azb = args[1]
+	case 3:
+		c.pa.subject = args[0]
+		c.pa.reply = args[1]
+		c.pa.size = parseSize(args[2])
+		c.pa.azb = args[2]
+	default:
+		return fmt.Errorf("processPub Parse Error: '%s'", arg)
+	}
+	if c.pa.size < 0 {
+		return fmt.Errorf("processPub Bad or Missing Size: '%s'", arg)
+	}
+	maxPayload := atomic.LoadInt64(&c.mpay)
+	if maxPayload > 0 && int64(c.pa.size) > maxPayload {
+		c.maxPayloadViolation(c.pa.size, maxPayload)
+		return ErrMaxPayload
+	}
+
+	// Published subjects must be literal. The payload still has to be
+	// consumed, so clear the subject to have the message dropped.
+	if !IsValidLiteralSubject(string(c.pa.subject)) {
+		c.sendErr("Invalid Publish Subject")
+		c.pa.subject = nil
+	}
+	return nil
+}
+
+// processMsgArgs parses the arguments of a MSG protocol line received
+// from a route: MSG <subject> <sid> [reply-to] <#bytes>
+func (c *client) processMsgArgs(arg []byte) error {
+	c.traceInOp("MSG", arg)
+
+	// Unroll splitArgs to avoid runtime/heap issues
+	a := [MAX_MSG_ARGS][]byte{}
+	args := a[:0]
+	start := -1
+	for i, b := range arg {
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			if start >= 0 {
+				args = append(args, arg[start:i])
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		args = append(args, arg[start:])
+	}
+
+	switch len(args) {
+	case 3:
+		c.pa.reply = nil
+		c.pa.azb = args[2]
+		c.pa.size = parseSize(args[2])
+	case 4:
+		c.pa.reply = args[2]
+		c.pa.azb = args[3]
+		c.pa.size = parseSize(args[3])
+	default:
+		return fmt.Errorf("processMsgArgs Parse Error: '%s'", arg)
+	}
+	if c.pa.size < 0 {
+		return fmt.Errorf("processMsgArgs Bad or Missing Size: '%s'", arg)
+	}
+
+	// Common ones processed after check for arg length
+	c.pa.subject = args[0]
+	c.pa.sid = args[1]
+
+	return nil
+}
+
 func splitArg(arg []byte) [][]byte {
 	a := [MAX_MSG_ARGS][]byte{}
 	args := a[:0]
@@ -447,6 +981,304 @@ func splitArg(arg []byte) [][]byte {
 	return args
 }
 
+// msgHeader builds the MSG protocol line for the given subscription,
+// mh already holds "MSG <subject> ".
+func (c *client) msgHeader(mh []byte, sub *subscription) []byte {
+	mh = append(mh, sub.sid...)
+	mh = append(mh, ' ')
+	if c.pa.reply != nil {
+		mh = append(mh, c.pa.reply...)
+		mh = append(mh, ' ')
+	}
+	mh = append(mh, c.pa.azb...)
+	mh = append(mh, "\r\n"...)
+	return mh
+}
+
+// deliverMsg 把消息写入订阅者的bufio.Writer，并把订阅者挂到c.pcd上，
+// 由readLoop在处理完这一批数据后统一flush。
+func (c *client) deliverMsg(sub *subscription, mh, msg []byte) {
+	if sub.client == nil {
+		return
+	}
+	client := sub.client
+	client.mu.Lock()
+
+	// Drop messages on denied subjects that a wildcard subscription covers.
+	if client.deliveryDenied(c.pa.subject) {
+		client.mu.Unlock()
+		return
+	}
+
+	sub.nm++
+	// Check if we should auto-unsubscribe.
+	if sub.max > 0 {
+		// For routing..
+		shouldForward := client.typ != ROUTER && client.srv != nil
+		// If we are at the exact number, unsubscribe but
+		// still process the message in hand, otherwise
+		// unsubscribe and drop message on the floor.
+		if sub.nm == sub.max {
+			c.Debugf("Auto-unsubscribe limit of %d reached for sid '%s'\n", sub.max, string(sub.sid))
+			// Due to defer, reverse the code order so that execution
+			// is consistent with other cases where we unsubscribe.
+			if shouldForward {
+				defer client.srv.broadcastUnSubscribe(sub)
+			}
+			defer client.unsubscribe(sub)
+		} else if sub.nm > sub.max {
+			c.Debugf("Auto-unsubscribe limit [%d] exceeded\n", sub.max)
+			client.mu.Unlock()
+			client.unsubscribe(sub)
+			if shouldForward {
+				client.srv.broadcastUnSubscribe(sub)
+			}
+			return
+		}
+	}
+
+	if client.nc == nil {
+		client.mu.Unlock()
+		return
+	}
+
+	// Check for a slow consumer before buffering more for this client.
+	if client.pb+len(mh)+len(msg) > client.srv.getOpts().MaxPending {
+		client.mu.Unlock()
+		client.slowConsumer(c.pa.subject)
+		return
+	}
+
+	// Update statistics
+
+	// The msg includes the CR_LF, so pull back out for accounting.
+	msgSize := int64(len(msg) - LEN_CR_LF)
+
+	// No atomic needed since accessed under client lock.
+	client.outMsgs++
+	client.outBytes += msgSize
+
+	atomic.AddInt64(&c.srv.outMsgs, 1)
+	atomic.AddInt64(&c.srv.outBytes, msgSize)
+
+	// Check to see if our writes will cause a flush
+	// in the underlying bufio. If so limit time we
+	// will wait for flush to complete.
+	deadlineSet := false
+	if client.bw.Available() < (len(mh) + len(msg)) {
+		client.wfc++
+		client.nc.SetWriteDeadline(time.Now().Add(client.srv.getOpts().WriteDeadline))
+		deadlineSet = true
+	}
+
+	// Deliver to the client.
+	_, err := client.bw.Write(mh)
+	if err != nil {
+		goto writeErr
+	}
+
+	_, err = client.bw.Write(msg)
+	if err != nil {
+		goto writeErr
+	}
+	client.pb += len(mh) + len(msg)
+
+	if c.trace {
+		client.traceOutOp(string(mh[:len(mh)-LEN_CR_LF]), nil)
+	}
+
+	if deadlineSet {
+		client.nc.SetWriteDeadline(time.Time{})
+	}
+
+	client.mu.Unlock()
+	c.pcd[client] = needFlush
+	return
+
+writeErr:
+	if deadlineSet {
+		client.nc.SetWriteDeadline(time.Time{})
+	}
+	client.mu.Unlock()
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		client.slowConsumer(c.pa.subject)
+		return
+	}
+	c.Debugf("Error writing msg: %v", err)
+	client.closeConnection()
+}
+
+// slowConsumer disconnects a client that can not keep up with the messages
+// delivered to it, either because its pending bytes went over MaxPending
+// or because a write missed the WriteDeadline. subject is the subject of
+// the message being delivered, nil when detected on flush.
+// Lock should not be held.
+func (c *client) slowConsumer(subject []byte) {
+	c.mu.Lock()
+	// Already closed, e.g. by another publisher.
+	if c.nc == nil {
+		c.mu.Unlock()
+		return
+	}
+	pending := c.pb
+	c.mu.Unlock()
+
+	atomic.AddInt64(&c.slowConsumers, 1)
+	atomic.AddInt64(&c.srv.slowConsumers, 1)
+
+	if subject != nil {
+		c.Noticef("Slow Consumer Detected - Subject %q, Pending %d bytes", subject, pending)
+	} else {
+		c.Noticef("Slow Consumer Detected - Pending %d bytes", pending)
+	}
+
+	// The client is not reading, so don't wait on a flush here,
+	// closeConnection() flushes what it can under the WriteDeadline.
+	c.mu.Lock()
+	c.traceOutOp("-ERR", []byte(ErrSlowConsumer.Error()))
+	c.sendProto([]byte(fmt.Sprintf("-ERR '%s'\r\n", ErrSlowConsumer.Error())), false)
+	c.mu.Unlock()
+	c.closeConnection()
+}
+
+// processMsg is called to process an inbound msg from a client or a route.
+func (c *client) processMsg(msg []byte) {
+	// Snapshot server.
+	srv := c.srv
+
+	// Update statistics
+	// The msg includes the CR_LF, so pull back out for accounting.
+	c.cache.inMsgs++
+	c.cache.inBytes += len(msg) - LEN_CR_LF
+
+	if c.trace {
+		c.traceMsg(msg)
+	}
+
+	// The subject was rejected in processPub, drop the message.
+	if len(c.pa.subject) == 0 {
+		return
+	}
+
+	if c.opts.Verbose {
+		c.sendOK()
+	}
+
+	// Mostly under testing scenarios.
+	if srv == nil {
+		return
+	}
+
+	// Check if published subject is allowed if we have permissions in place.
+	if !c.pubAllowed(c.pa.subject) {
+		c.pubPermissionViolation(c.pa.subject)
+		return
+	}
+
+	var r *SublistResult
+	var ok bool
+
+	// 先查本连接的结果缓存，Sublist的genid变化说明订阅有变动，缓存需要作废
+	genid := atomic.LoadUint64(&srv.sl.genid)
+
+	if genid == c.cache.genid && c.cache.results != nil {
+		r, ok = c.cache.results[string(c.pa.subject)]
+	} else {
+		// reset
+		c.cache.results = make(map[string]*SublistResult)
+		c.cache.genid = genid
+	}
+
+	if !ok {
+		subject := string(c.pa.subject)
+		r = srv.sl.Match(subject)
+		c.cache.results[subject] = r
+		if len(c.cache.results) > maxResultCacheSize {
+			// Prune the results cache. Keeps us from unbounded growth.
+			n := 0
+			for subject := range c.cache.results {
+				delete(c.cache.results, subject)
+				if n++; n > pruneSize {
+					break
+				}
+			}
+		}
+	}
+
+	// Check for no interest, short circuit if so.
+	if len(r.psubs) == 0 && len(r.qsubs) == 0 {
+		return
+	}
+
+	// Scratch buffer..
+	msgh := c.msgb[:len(msgHeadProto)]
+
+	// msg header
+	msgh = append(msgh, c.pa.subject...)
+	msgh = append(msgh, ' ')
+	si := len(msgh)
+
+	isRoute := c.typ == ROUTER
+
+	// If we are a route and we have a queue subscription, deliver direct
+	// since they are sent direct via L2 semantics. If the match is a queue
+	// subscription, we will return from here regardless if we find a sub.
+	if isRoute {
+		isQueue, sub, err := srv.routeSidQueueSubscriber(c.pa.sid)
+		if err != nil {
+			c.Debugf("%v", err)
+			return
+		}
+		if isQueue {
+			if sub != nil {
+				mh := c.msgHeader(msgh[:si], sub)
+				c.deliverMsg(sub, mh, msg)
+			}
+			return
+		}
+	}
+
+	// Used to only send normal subscriptions once across a given route.
+	var rmap map[string]struct{}
+
+	// Loop over all normal subscriptions that match.
+	for _, sub := range r.psubs {
+		// Check if this is a send to a ROUTER. The other side will handle
+		// the appropriate re-processing and fan-out.
+		if sub.client.typ == ROUTER {
+			if rmap == nil {
+				rmap = make(map[string]struct{}, srv.numRoutes())
+			}
+			if !c.checkRouteDelivery(sub, rmap) {
+				continue
+			}
+		}
+		// Normal delivery
+		mh := c.msgHeader(msgh[:si], sub)
+		c.deliverMsg(sub, mh, msg)
+	}
+
+	// Now process any queue subs we have if not a route
+	if !isRoute {
+		// Check to see if we have our own rand yet. Global rand
+		// has contention with lots of clients, etc.
+		if c.cache.prand == nil {
+			c.cache.prand = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		// Process queue subs, one random member per group
+		for i := 0; i < len(r.qsubs); i++ {
+			qsubs := r.qsubs[i]
+			index := c.cache.prand.Intn(len(qsubs))
+			sub := qsubs[index]
+			if sub != nil {
+				mh := c.msgHeader(msgh[:si], sub)
+				c.deliverMsg(sub, mh, msg)
+			}
+		}
+	}
+}
+
 func (c *client) processPing() {
 	c.mu.Lock()
 	c.traceInOp("PING", nil)
@@ -516,13 +1348,41 @@ func (c *client) traceOp(format, op string, arg []byte) {
 	if arg != nil {
 		opa = append(opa, string(arg))
 	}
-	c.Tracef(format, opa)
+	c.Tracef(format, opa...)
+}
+
+func (c *client) traceMsg(msg []byte) {
+	if !c.trace {
+		return
+	}
+	c.Tracef("->> MSG_PAYLOAD: [%s]", string(msg[:len(msg)-LEN_CR_LF]))
 }
 
 // Used to treat maps as efficient set
 var needFlush = struct{}{}
 var routeSeen = struct{}{}
 
+// Assume the lock is held upon entry.
+// 写入的数据先进入bufio.Writer，只有在doFlush或缓冲区不足时才会设置写超时。
+func (c *client) sendProto(info []byte, doFlush bool) error {
+	var err error
+	if c.bw != nil && c.nc != nil {
+		deadlineSet := false
+		if doFlush || c.bw.Available() < len(info) {
+			c.nc.SetWriteDeadline(time.Now().Add(c.srv.getOpts().WriteDeadline))
+			deadlineSet = true
+		}
+		_, err = c.bw.Write(info)
+		if err == nil && doFlush {
+			err = c.bw.Flush()
+		}
+		if deadlineSet {
+			c.nc.SetWriteDeadline(time.Time{})
+		}
+	}
+	return err
+}
+
 // Assume the lock is held upon entry.
 func (c *client) sendInfo(info []byte) {
 	c.sendProto(info, true)
@@ -551,6 +1411,9 @@ func (c *client) authTimeout() {
 }
 
 func (c *client) authViolation() {
+	if c.srv != nil {
+		atomic.AddInt64(&c.srv.authFailures, 1)
+	}
 	if c.srv != nil && c.srv.getOpts().Users != nil {
 		c.Errorf("%s - User %q",
 			ErrAuthorization.Error(),
@@ -574,23 +1437,36 @@ func (c *client) RegisterUser(user *User) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Pre-allocate all to simplify(简化) checks later.
+	// Pre-allocate the cache, the Sublists are only created when
+	// there is something to check against.
 	c.perms = &permissions{}
-	c.perms.sub = NewSubList()
-	c.perms.pub = NewSubList()
 	c.perms.pcache = make(map[string]bool)
 
 	// Loop over publish permissions
-	for _, pubSubject := range user.Permissions.Publish {
-		sub := &subscription{subject: []byte(pubSubject)}
-		c.perms.pub.Insert(sub)
+	if pp := user.Permissions.Publish; pp != nil {
+		c.perms.pub = newPermSublist(pp.Allow)
+		c.perms.pubDeny = newPermSublist(pp.Deny)
 	}
 
 	// Loop over subscribe permissions
-	for _, subSubject := range user.Permissions.Subscribe {
-		sub := &subscription{subject: []byte(subSubject)}
-		c.perms.sub.Insert(sub)
+	if sp := user.Permissions.Subscribe; sp != nil {
+		c.perms.sub = newPermSublist(sp.Allow)
+		c.perms.subDeny = newPermSublist(sp.Deny)
+	}
+}
+
+// newPermSublist returns a Sublist holding the given subjects,
+// or nil if there are none.
+func newPermSublist(subjects []string) *Sublist {
+	if len(subjects) == 0 {
+		return nil
+	}
+	sl := NewSubList()
+	for _, subject := range subjects {
+		sub := &subscription{subject: []byte(subject)}
+		sl.Insert(sub)
 	}
+	return sl
 }
 
 // Logging functionality scoped to a client or route.
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// onlyClient returns the single client registered with the server.
+func onlyClient(t *testing.T, s *Server) *client {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.clients) != 1 {
+		t.Fatalf("Expected 1 client, got %d", len(s.clients))
+	}
+	for _, c := range s.clients {
+		return c
+	}
+	return nil
+}
+
+func TestClientCloseRemovesSubscriptions(t *testing.T) {
+	s := runServer(t, &Options{})
+	defer s.Shutdown()
+
+	c := newTestConn(t, s)
+	c.connect(`{"verbose":false}`)
+	c.send("SUB foo 1\r\nSUB bar workers 2\r\n")
+	c.flush()
+	if n := s.sl.Count(); n != 2 {
+		t.Fatalf("Expected 2 subscriptions, got %d", n)
+	}
+	cli := onlyClient(t, s)
+
+	c.close()
+	checkFor(t, 2*time.Second, func() error {
+		if n := s.NumClients(); n != 0 {
+			return fmt.Errorf("Expected no clients, got %d", n)
+		}
+		if n := s.sl.Count(); n != 0 {
+			return fmt.Errorf("Expected no subscriptions, got %d", n)
+		}
+		return nil
+	})
+
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	if cli.nc != nil || cli.ptmr != nil || cli.atmr != nil {
+		t.Fatal("Expected the connection and its timers to be cleared")
+	}
+}
+
+func TestClientCloseConnectionFlushes(t *testing.T) {
+	s := runServer(t, &Options{})
+	defer s.Shutdown()
+
+	c := newTestConn(t, s)
+	c.connect(`{"verbose":false}`)
+	cli := onlyClient(t, s)
+
+	// Whatever is buffered is flushed before the socket is closed.
+	cli.mu.Lock()
+	cli.sendProto([]byte("PING\r\n"), false)
+	cli.mu.Unlock()
+	cli.closeConnection()
+
+	c.expect("PING")
+	c.expectClosed()
+	if n := s.NumClients(); n != 0 {
+		t.Fatalf("Expected no clients, got %d", n)
+	}
+}
+
+func TestClientStaleConnection(t *testing.T) {
+	s := runServer(t, &Options{PingInterval: 50 * time.Millisecond, MaxPingsOut: 2})
+	defer s.Shutdown()
+
+	// Never answer the server PINGs.
+	c := newTestConn(t, s)
+	c.connect(`{"verbose":false}`)
+	for i := 0; i < 2; i++ {
+		c.expect("PING")
+	}
+	c.expect(fmt.Sprintf("-ERR '%s'", ErrStaleConnection))
+	c.expectClosed()
+	checkFor(t, 2*time.Second, func() error {
+		if n := s.NumClients(); n != 0 {
+			return fmt.Errorf("Expected no clients, got %d", n)
+		}
+		return nil
+	})
+}
+
+func TestClientPongResetsPingsOut(t *testing.T) {
+	s := runServer(t, &Options{PingInterval: 50 * time.Millisecond, MaxPingsOut: 1})
+	defer s.Shutdown()
+
+	// Answering every PING keeps the connection alive past MaxPingsOut.
+	c := newTestConn(t, s)
+	defer c.close()
+	c.connect(`{"verbose":false}`)
+	for i := 0; i < 5; i++ {
+		c.expect("PING")
+		c.send("PONG\r\n")
+	}
+	if n := s.NumClients(); n != 1 {
+		t.Fatalf("Expected the client to still be connected, got %d clients", n)
+	}
+}
+
+func TestClientAuthTimeout(t *testing.T) {
+	s := runServer(t, &Options{Authorization: "secret"})
+	defer s.Shutdown()
+
+	// Never send CONNECT.
+	c := newTestConn(t, s)
+	defer c.close()
+	start := time.Now()
+	c.expect(fmt.Sprintf("-ERR '%s'", ErrAuthTimeout))
+	if d := time.Since(start); d < AUTH_TIMEOUT/2 {
+		t.Fatalf("Authorization timeout fired too early: %v", d)
+	}
+	c.expectClosed()
+}
+
+func TestClientConnectClearsAuthTimer(t *testing.T) {
+	s := runServer(t, &Options{Authorization: "secret"})
+	defer s.Shutdown()
+
+	c := newTestConn(t, s)
+	defer c.close()
+	// The client is registered and the timer armed after INFO is sent.
+	var cli *client
+	checkFor(t, 2*time.Second, func() error {
+		if s.NumClients() != 1 {
+			return fmt.Errorf("Expected the client to be registered")
+		}
+		if cli = onlyClient(t, s); !cli.isAuthTimerSet() {
+			return fmt.Errorf("Expected the authorization timer to be set")
+		}
+		return nil
+	})
+	c.connect(`{"verbose":false,"auth_token":"secret"}`)
+	if cli.isAuthTimerSet() {
+		t.Fatal("Expected CONNECT to clear the authorization timer")
+	}
+}
+
+func TestRouteAuthTimeout(t *testing.T) {
+	s := runServer(t, &Options{Cluster: ClusterOpts{
+		Host: "127.0.0.1", Port: RANDOM_PORT,
+		Username: "ruser", Password: "top_secret", AuthTimeout: 0.1,
+	}})
+	defer s.Shutdown()
+
+	// A route that never sends CONNECT uses Cluster.AuthTimeout.
+	nc, err := net.Dial("tcp", s.clusterAddr().String())
+	if err != nil {
+		t.Fatalf("Could not connect to route port: %v", err)
+	}
+	c := &testConn{t: t, nc: nc, br: bufio.NewReader(nc)}
+	defer c.close()
+	c.expect("INFO ")
+	c.expect(fmt.Sprintf("-ERR '%s'", ErrAuthTimeout))
+	c.expectClosed()
+}
+
+func TestClientPubFanOut(t *testing.T) {
+	s := runServer(t, &Options{})
+	defer s.Shutdown()
+
+	subs := make([]*testConn, 3)
+	for i := range subs {
+		subs[i] = newTestConn(t, s)
+		defer subs[i].close()
+		subs[i].connect(`{"verbose":false}`)
+		subs[i].send("SUB foo.* %d\r\n", i+1)
+		subs[i].flush()
+	}
+
+	pub := newTestConn(t, s)
+	defer pub.close()
+	pub.connect(`{"verbose":false}`)
+	pub.send("PUB foo.bar 5\r\nhello\r\n")
+	pub.flush()
+
+	for i, c := range subs {
+		c.expectMsg("foo.bar", fmt.Sprintf("%d", i+1), "hello")
+	}
+}
+
+func TestClientQueueGroupSingleDelivery(t *testing.T) {
+	s := runServer(t, &Options{})
+	defer s.Shutdown()
+
+	c := newTestConn(t, s)
+	defer c.close()
+	c.connect(`{"verbose":false}`)
+	c.send("SUB foo workers 1\r\nSUB foo workers 2\r\nSUB foo 3\r\n")
+	c.flush()
+
+	const total = 20
+	for i := 0; i < total; i++ {
+		c.send("PUB foo 2\r\nok\r\n")
+	}
+	c.send("PING\r\n")
+
+	counts := make(map[string]int)
+	for {
+		line := c.readLine()
+		if line == "PONG" {
+			break
+		}
+		args := strings.Fields(line)
+		if len(args) < 4 || args[0] != "MSG" {
+			t.Fatalf("Unexpected line %q", line)
+		}
+		counts[args[2]]++
+		c.readLine()
+	}
+	if counts["3"] != total {
+		t.Fatalf("Expected %d messages for the plain subscriber, got %d", total, counts["3"])
+	}
+	if n := counts["1"] + counts["2"]; n != total {
+		t.Fatalf("Expected %d messages across the queue group, got %d", total, n)
+	}
+}
+
+func TestClientMaxPayloadViolation(t *testing.T) {
+	s := runServer(t, &Options{MaxPayload: 8})
+	defer s.Shutdown()
+
+	c := newTestConn(t, s)
+	defer c.close()
+	c.connect(`{"verbose":false}`)
+	c.send("PUB foo 8\r\n12345678\r\n")
+	c.flush()
+
+	c.send("PUB foo 9\r\n123456789\r\n")
+	c.expect("-ERR 'Maximum Payload Violation'")
+	c.expectClosed()
+}
+
+func TestClientReplySubject(t *testing.T) {
+	s := runServer(t, &Options{})
+	defer s.Shutdown()
+
+	c := newTestConn(t, s)
+	defer c.close()
+	c.connect(`{"verbose":false}`)
+	c.send("SUB foo 1\r\nPUB foo bar 2\r\nok\r\nPUB foo 2\r\nok\r\n")
+
+	args := c.expectMsg("foo", "1", "ok")
+	if len(args) != 5 || args[3] != "bar" || args[4] != "2" {
+		t.Fatalf("Expected reply subject %q, got %q", "bar", args)
+	}
+	args = c.expectMsg("foo", "1", "ok")
+	if len(args) != 4 {
+		t.Fatalf("Expected no reply subject, got %q", args)
+	}
+}
+
+func TestClientAutoUnsubscribe(t *testing.T) {
+	s := runServer(t, &Options{})
+	defer s.Shutdown()
+
+	c := newTestConn(t, s)
+	defer c.close()
+	c.connect(`{"verbose":false}`)
+	c.send("SUB foo 1\r\nUNSUB 1 3\r\n")
+	for i := 0; i < 5; i++ {
+		c.send("PUB foo 2\r\nok\r\n")
+	}
+	c.send("PING\r\n")
+
+	got := 0
+	for c.readLine() != "PONG" {
+		c.readLine()
+		got++
+	}
+	if got != 3 {
+		t.Fatalf("Expected exactly 3 messages, got %d", got)
+	}
+	if n := s.sl.Count(); n != 0 {
+		t.Fatalf("Expected no subscriptions, got %d", n)
+	}
+	cli := onlyClient(t, s)
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	if len(cli.subs) != 0 {
+		t.Fatalf("Expected the client to have no subscriptions, got %d", len(cli.subs))
+	}
+}
+
+func TestClientCanSubscribeWildcardSubset(t *testing.T) {
+	c := &client{}
+	c.RegisterUser(&User{Permissions: &Permissions{
+		Subscribe: &SubjectPermission{Allow: []string{"foo.>", "bar.*"}},
+	}})
+	for _, tc := range []struct {
+		subject string
+		allowed bool
+	}{
+		{"foo.bar", true},
+		{"foo.bar.*", true},
+		{"foo.*.baz", true},
+		{"foo.>", true},
+		{"bar.baz", true},
+		{"bar.*", true},
+		{"foo", false},
+		{">", false},
+		{"*.bar", false},
+		{"bar.>", false},
+		{"bar.*.baz", false},
+	} {
+		if got := c.canSubscribe([]byte(tc.subject)); got != tc.allowed {
+			t.Fatalf("Subscribe to %q: expected allowed=%v, got %v", tc.subject, tc.allowed, got)
+		}
+	}
+}
+
+func TestClientPermCacheBounded(t *testing.T) {
+	c := &client{}
+	c.RegisterUser(&User{Permissions: &Permissions{
+		Publish: &SubjectPermission{Allow: []string{"foo.*"}},
+	}})
+	for i := 0; i < 4*maxPermCacheSize; i++ {
+		subject := fmt.Sprintf("foo.%d", i)
+		if !c.pubAllowed([]byte(subject)) {
+			t.Fatalf("Expected publish to %q to be allowed", subject)
+		}
+		if n := len(c.perms.pcache); n > maxPermCacheSize {
+			t.Fatalf("Expected at most %d cached entries, got %d", maxPermCacheSize, n)
+		}
+	}
+	// Cached results must not change the answer.
+	if c.pubAllowed([]byte("bar")) || c.pubAllowed([]byte("bar")) {
+		t.Fatal("Expected publish to \"bar\" to be denied")
+	}
+}
+
+func TestClientPermissionsViolationErrors(t *testing.T) {
+	perms := &Permissions{
+		Publish:   &SubjectPermission{Allow: []string{"foo"}},
+		Subscribe: &SubjectPermission{Allow: []string{"foo"}},
+	}
+	s := runServer(t, &Options{Users: []*User{{Username: "alice", Password: "pwd", Permissions: perms}}})
+	defer s.Shutdown()
+
+	c := newTestConn(t, s)
+	defer c.close()
+	c.connect(`{"verbose":false,"user":"alice","pass":"pwd"}`)
+
+	c.send("PUB bar 2\r\nok\r\n")
+	if line := c.readLine(); line != `-ERR 'Permissions Violation for Publish to "bar"'` {
+		t.Fatalf("Unexpected publish violation: %q", line)
+	}
+	c.send("SUB bar 1\r\n")
+	if line := c.readLine(); line != `-ERR 'Permissions Violation for Subscription to "bar"'` {
+		t.Fatalf("Unexpected subscription violation: %q", line)
+	}
+
+	// Violations are not fatal.
+	c.send("SUB foo 1\r\nPUB foo 2\r\nok\r\n")
+	c.expectMsg("foo", "1", "ok")
+	c.flush()
+}
+
+func TestClientRegisterUserPermissions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		perm    *SubjectPermission
+		allowed []string
+		denied  []string
+	}{
+		{"allow only", &SubjectPermission{Allow: []string{"foo", "bar.*"}},
+			[]string{"foo", "bar.baz"}, []string{"baz", "bar.baz.qux"}},
+		{"deny wins", &SubjectPermission{Allow: []string{"orders.>"}, Deny: []string{"orders.admin.>"}},
+			[]string{"orders.new", "orders.admin"}, []string{"orders.admin.delete", "users.new"}},
+		{"empty allow", &SubjectPermission{},
+			[]string{"foo", "orders.new"}, nil},
+		{"deny only", &SubjectPermission{Deny: []string{"orders.admin.>"}},
+			[]string{"foo", "orders.new", "orders.admin"}, []string{"orders.admin.delete"}},
+	} {
+		c := &client{}
+		c.RegisterUser(&User{Permissions: &Permissions{Publish: tc.perm, Subscribe: tc.perm}})
+		for _, subject := range tc.allowed {
+			if !c.pubAllowed([]byte(subject)) || !c.canSubscribe([]byte(subject)) {
+				t.Fatalf("%s: expected %q to be allowed", tc.name, subject)
+			}
+		}
+		for _, subject := range tc.denied {
+			if c.pubAllowed([]byte(subject)) || c.canSubscribe([]byte(subject)) {
+				t.Fatalf("%s: expected %q to be denied", tc.name, subject)
+			}
+		}
+	}
+
+	// No permissions at all means no restrictions.
+	c := &client{}
+	c.RegisterUser(&User{Permissions: &Permissions{}})
+	if !c.pubAllowed([]byte("foo")) || !c.canSubscribe([]byte("foo")) {
+		t.Fatal("Expected unset permissions to allow everything")
+	}
+}
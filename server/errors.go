@@ -28,6 +28,14 @@ var (
 	// server has been reached.
 	ErrTooManyConnections = errors.New("Maximum Connections Exceeded")
 
+	// ErrStaleConnection represents an error condition on a connection that
+	// did not answer MaxPingsOut consecutive PINGs.
+	ErrStaleConnection = errors.New("Stale Connection")
+
+	// ErrSlowConsumer represents an error condition on a client that can not
+	// keep up with the messages delivered to it.
+	ErrSlowConsumer = errors.New("Slow Consumer Detected")
+
 	// ErrClientConnectedToRoutePort represents an error condition when a client
 	// attempted to connect to the route listen port.
 	ErrClientConnectedToRoutePort = errors.New("Attempted To Connect To Route Port")
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// MetricsPath is the monitoring endpoint serving the Prometheus text format.
+const MetricsPath = "/metrics"
+
+// metricsContentType is the content type of the Prometheus text format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Prometheus metric types.
+const (
+	counterMetric = "counter"
+	gaugeMetric   = "gauge"
+)
+
+// metricsWriter renders metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+// family writes the HELP and TYPE lines that start a metric family.
+func (mw *metricsWriter) family(name, typ, help string) {
+	mw.buf.WriteString("# HELP ")
+	mw.buf.WriteString(name)
+	mw.buf.WriteByte(' ')
+	mw.buf.WriteString(help)
+	mw.buf.WriteString("\n# TYPE ")
+	mw.buf.WriteString(name)
+	mw.buf.WriteByte(' ')
+	mw.buf.WriteString(typ)
+	mw.buf.WriteByte('\n')
+}
+
+// sample writes a single sample, labels are given as name/value pairs.
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	mw.buf.WriteString(name)
+	if len(labels) > 0 {
+		mw.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.buf.WriteByte(',')
+			}
+			mw.buf.WriteString(labels[i])
+			mw.buf.WriteString(`="`)
+			mw.buf.WriteString(labelEscaper.Replace(labels[i+1]))
+			mw.buf.WriteByte('"')
+		}
+		mw.buf.WriteByte('}')
+	}
+	mw.buf.WriteByte(' ')
+	mw.buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	mw.buf.WriteByte('\n')
+}
+
+// metric writes a metric family holding a single unlabeled sample.
+func (mw *metricsWriter) metric(name, typ, help string, value float64) {
+	mw.family(name, typ, help)
+	mw.sample(name, value)
+}
+
+// Label values need backslash, double quote and newline escaped.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// connMetrics is a snapshot of a client's counters taken under its lock.
+type connMetrics struct {
+	cid           uint64
+	name          string
+	user          string
+	subs          int
+	pending       int
+	inMsgs        int64
+	outMsgs       int64
+	inBytes       int64
+	outBytes      int64
+	slowConsumers int64
+}
+
+// Metrics renders the server, connection and Sublist counters in the
+// Prometheus text format.
+func (s *Server) Metrics() []byte {
+	s.mu.Lock()
+	info := s.info
+	start := s.start
+	numConns := len(s.clients)
+	totalConns := s.totalClients
+	numRoutes := len(s.routes)
+	numRemotes := len(s.remotes)
+	hasUsers := s.users != nil
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	conns := make([]connMetrics, 0, len(clients))
+	for _, c := range clients {
+		c.mu.Lock()
+		cm := connMetrics{
+			cid:      c.cid,
+			name:     c.opts.Name,
+			subs:     len(c.subs),
+			outMsgs:  c.outMsgs,
+			outBytes: c.outBytes,
+		}
+		if hasUsers {
+			cm.user = c.opts.Username
+		}
+		if c.bw != nil {
+			cm.pending = c.bw.Buffered()
+		}
+		c.mu.Unlock()
+		cm.inMsgs = atomic.LoadInt64(&c.inMsgs)
+		cm.inBytes = atomic.LoadInt64(&c.inBytes)
+		cm.slowConsumers = atomic.LoadInt64(&c.slowConsumers)
+		conns = append(conns, cm)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].cid < conns[j].cid })
+
+	mw := &metricsWriter{}
+
+	mw.family("nats_server_info", gaugeMetric, "Information about the server.")
+	mw.sample("nats_server_info", 1, "server_id", info.ID, "version", info.Version, "go_version", info.GoVersion)
+	mw.metric("nats_server_start_time_seconds", gaugeMetric,
+		"Start time of the server since unix epoch in seconds.", float64(start.UnixNano())/1e9)
+
+	// Server wide stats
+	mw.metric("nats_server_in_msgs_total", counterMetric,
+		"Messages received from clients and routes.", float64(atomic.LoadInt64(&s.inMsgs)))
+	mw.metric("nats_server_out_msgs_total", counterMetric,
+		"Messages sent to clients and routes.", float64(atomic.LoadInt64(&s.outMsgs)))
+	mw.metric("nats_server_in_bytes_total", counterMetric,
+		"Payload bytes received from clients and routes.", float64(atomic.LoadInt64(&s.inBytes)))
+	mw.metric("nats_server_out_bytes_total", counterMetric,
+		"Payload bytes sent to clients and routes.", float64(atomic.LoadInt64(&s.outBytes)))
+	mw.metric("nats_server_slow_consumers_total", counterMetric,
+		"Connections closed as slow consumers.", float64(atomic.LoadInt64(&s.slowConsumers)))
+	mw.metric("nats_server_auth_failures_total", counterMetric,
+		"Connections closed for failing authorization.", float64(atomic.LoadInt64(&s.authFailures)))
+
+	mw.metric("nats_server_connections", gaugeMetric,
+		"Current number of client connections.", float64(numConns))
+	mw.metric("nats_server_connections_total", counterMetric,
+		"Client connections accepted since start.", float64(totalConns))
+	mw.metric("nats_server_routes", gaugeMetric,
+		"Current number of routes.", float64(numRoutes))
+	mw.metric("nats_server_remotes", gaugeMetric,
+		"Current number of remote servers routed to.", float64(numRemotes))
+
+	// Sublist
+	st := s.sl.Stats()
+	mw.metric("nats_server_subscriptions", gaugeMetric,
+		"Current number of subscriptions.", float64(st.NumSubs))
+	mw.metric("nats_server_sublist_cache_entries", gaugeMetric,
+		"Current number of subjects in the sublist match cache.", float64(st.NumCache))
+	mw.metric("nats_server_sublist_inserts_total", counterMetric,
+		"Subscriptions inserted into the sublist.", float64(st.NumInserts))
+	mw.metric("nats_server_sublist_removes_total", counterMetric,
+		"Subscriptions removed from the sublist.", float64(st.NumRemoves))
+	mw.metric("nats_server_sublist_matches_total", counterMetric,
+		"Subject matches performed by the sublist.", float64(st.NumMatches))
+	mw.metric("nats_server_sublist_cache_hit_ratio", gaugeMetric,
+		"Ratio of sublist matches served from the cache.", st.CacheHitRate)
+	mw.metric("nats_server_sublist_max_fanout", gaugeMetric,
+		"Largest number of subscribers for a cached subject.", float64(st.MaxFanout))
+	mw.metric("nats_server_sublist_avg_fanout", gaugeMetric,
+		"Average number of subscribers for a cached subject.", st.AvgFanout)
+
+	// Per connection, labeled by connection id, client name and user.
+	connFamilies := []struct {
+		name, typ, help string
+		value           func(cm *connMetrics) float64
+	}{
+		{"nats_connection_in_msgs_total", counterMetric, "Messages received from the connection.",
+			func(cm *connMetrics) float64 { return float64(cm.inMsgs) }},
+		{"nats_connection_out_msgs_total", counterMetric, "Messages sent to the connection.",
+			func(cm *connMetrics) float64 { return float64(cm.outMsgs) }},
+		{"nats_connection_in_bytes_total", counterMetric, "Payload bytes received from the connection.",
+			func(cm *connMetrics) float64 { return float64(cm.inBytes) }},
+		{"nats_connection_out_bytes_total", counterMetric, "Payload bytes sent to the connection.",
+			func(cm *connMetrics) float64 { return float64(cm.outBytes) }},
+		{"nats_connection_slow_consumers_total", counterMetric, "Times the connection was a slow consumer.",
+			func(cm *connMetrics) float64 { return float64(cm.slowConsumers) }},
+		{"nats_connection_subscriptions", gaugeMetric, "Current number of subscriptions of the connection.",
+			func(cm *connMetrics) float64 { return float64(cm.subs) }},
+		{"nats_connection_pending_bytes", gaugeMetric, "Bytes buffered to be sent to the connection.",
+			func(cm *connMetrics) float64 { return float64(cm.pending) }},
+	}
+	for _, f := range connFamilies {
+		mw.family(f.name, f.typ, f.help)
+		for i := range conns {
+			cm := &conns[i]
+			mw.sample(f.name, f.value(cm),
+				"cid", strconv.FormatUint(cm.cid, 10), "name", cm.name, "user", cm.user)
+		}
+	}
+
+	return mw.buf.Bytes()
+}
+
+// HandleMetrics process HTTP requests for metrics in the Prometheus
+// text format.
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.countRequest(MetricsPath)
+	w.Header().Set("Content-Type", metricsContentType)
+	w.Write(s.Metrics())
+}
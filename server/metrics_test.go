@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsWriterEscapesLabels(t *testing.T) {
+	mw := &metricsWriter{}
+	mw.sample("foo", 1.5, "name", "a\"b\\c\nd", "user", "")
+	if got, want := mw.buf.String(), `foo{name="a\"b\\c\nd",user=""} 1.5`+"\n"; got != want {
+		t.Fatalf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	s := runServer(t, &Options{HTTPPort: RANDOM_PORT, Authorization: "secret"})
+	defer s.Shutdown()
+
+	c := newTestConn(t, s)
+	defer c.close()
+	c.connect(`{"verbose":false,"name":"prom","auth_token":"secret"}`)
+	c.send("SUB foo 1\r\nPUB foo 2\r\nok\r\n")
+	c.expectMsg("foo", "1", "ok")
+	c.flush()
+
+	// An authorization failure from a second connection.
+	bad := newTestConn(t, s)
+	defer bad.close()
+	bad.send("CONNECT {\"verbose\":false,\"auth_token\":\"wrong\"}\r\nPING\r\n")
+	bad.expect("-ERR 'Authorization Violation'")
+	bad.expectClosed()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", s.MonitorAddr(), MetricsPath))
+	if err != nil {
+		t.Fatalf("Could not get metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != metricsContentType {
+		t.Fatalf("Unexpected content type %q", ct)
+	}
+	samples := make(map[string]string)
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			t.Fatalf("Malformed sample %q", line)
+		}
+		samples[line[:i]] = line[i+1:]
+	}
+
+	for name, want := range map[string]string{
+		"nats_server_in_msgs_total":                                   "1",
+		"nats_server_out_msgs_total":                                  "1",
+		"nats_server_in_bytes_total":                                  "2",
+		"nats_server_connections":                                     "1",
+		"nats_server_connections_total":                               "2",
+		"nats_server_routes":                                          "0",
+		"nats_server_auth_failures_total":                             "1",
+		"nats_server_subscriptions":                                   "1",
+		"nats_server_slow_consumers_total":                            "0",
+		`nats_connection_in_msgs_total{cid="1",name="prom",user=""}`:  "1",
+		`nats_connection_out_msgs_total{cid="1",name="prom",user=""}`: "1",
+		`nats_connection_subscriptions{cid="1",name="prom",user=""}`:  "1",
+	} {
+		if got := samples[name]; got != want {
+			t.Fatalf("Expected %s to be %s, got %q", name, want, got)
+		}
+	}
+}
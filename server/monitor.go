@@ -0,0 +1,682 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Monitoring endpoints.
+const (
+	RootPath   = "/"
+	VarzPath   = "/varz"
+	ConnzPath  = "/connz"
+	RoutezPath = "/routez"
+	SubszPath  = "/subsz"
+)
+
+// DefaultConnListSize is the default size of the connection list.
+const DefaultConnListSize = 1024
+
+// StartMonitoring starts the HTTP or HTTPs server if needed.
+func (s *Server) StartMonitoring() error {
+	// Snapshot server options.
+	opts := s.getOpts()
+
+	// Specifying both HTTP and HTTPS ports is a misconfiguration
+	if opts.HTTPPort != 0 && opts.HTTPSPort != 0 {
+		return fmt.Errorf("can't specify both HTTP (%v) and HTTPs (%v) ports", opts.HTTPPort, opts.HTTPSPort)
+	}
+	var err error
+	if opts.HTTPPort != 0 {
+		err = s.startMonitoring(false)
+	} else if opts.HTTPSPort != 0 {
+		if opts.TLSConfig == nil {
+			return errors.New("TLS cert and key required for HTTPS")
+		}
+		err = s.startMonitoring(true)
+	}
+	return err
+}
+
+// Start the monitoring server
+func (s *Server) startMonitoring(secure bool) error {
+	// Snapshot server options.
+	opts := s.getOpts()
+
+	var (
+		hp           string
+		err          error
+		httpListener net.Listener
+		port         int
+	)
+
+	monitorProtocol := "http"
+
+	if secure {
+		monitorProtocol += "s"
+		port = opts.HTTPSPort
+		if port == RANDOM_PORT {
+			port = 0
+		}
+		hp = net.JoinHostPort(opts.HTTPHost, strconv.Itoa(port))
+		config := opts.TLSConfig.Clone()
+		config.ClientAuth = tls.NoClientCert
+		httpListener, err = tls.Listen("tcp", hp, config)
+	} else {
+		port = opts.HTTPPort
+		if port == RANDOM_PORT {
+			port = 0
+		}
+		hp = net.JoinHostPort(opts.HTTPHost, strconv.Itoa(port))
+		httpListener, err = net.Listen("tcp", hp)
+	}
+
+	if err != nil {
+		return fmt.Errorf("can't listen to the monitor port: %v", err)
+	}
+
+	s.Noticef("Starting %s monitor on %s", monitorProtocol,
+		net.JoinHostPort(opts.HTTPHost, strconv.Itoa(httpListener.Addr().(*net.TCPAddr).Port)))
+
+	mux := http.NewServeMux()
+
+	// Root
+	mux.HandleFunc(RootPath, s.HandleRoot)
+	// Varz
+	mux.HandleFunc(VarzPath, s.HandleVarz)
+	// Connz
+	mux.HandleFunc(ConnzPath, s.HandleConnz)
+	// Routez
+	mux.HandleFunc(RoutezPath, s.HandleRoutez)
+	// Subz
+	mux.HandleFunc(SubszPath, s.HandleSubsz)
+	// Metrics
+	mux.HandleFunc(MetricsPath, s.HandleMetrics)
+
+	srv := &http.Server{
+		Addr:           hp,
+		Handler:        mux,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	s.mu.Lock()
+	s.http = httpListener
+	s.mu.Unlock()
+
+	go func() {
+		srv.Serve(httpListener)
+		srv.Handler = nil
+		s.done <- true
+	}()
+
+	return nil
+}
+
+// MonitorAddr will return the net.Addr object for the monitoring listener.
+func (s *Server) MonitorAddr() *net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.http == nil {
+		return nil
+	}
+	return s.http.Addr().(*net.TCPAddr)
+}
+
+// countRequest keeps track of the number of requests per endpoint,
+// reported in /varz.
+func (s *Server) countRequest(path string) {
+	s.mu.Lock()
+	s.httpReqStats[path]++
+	s.mu.Unlock()
+}
+
+// Varz will output server information on the monitoring port at /varz.
+type Varz struct {
+	*Info
+	*Options
+	Port             int               `json:"port"`
+	ProfPort         int               `json:"prof_port,omitempty"`
+	MaxPayload       int               `json:"max_payload"`
+	Start            time.Time         `json:"start"`
+	Now              time.Time         `json:"now"`
+	Uptime           string            `json:"uptime"`
+	Mem              int64             `json:"mem"`
+	Cores            int               `json:"cores"`
+	CPU              float64           `json:"cpu"`
+	Connections      int               `json:"connections"`
+	TotalConnections uint64            `json:"total_connections"`
+	Routes           int               `json:"routes"`
+	Remotes          int               `json:"remotes"`
+	InMsgs           int64             `json:"in_msgs"`
+	OutMsgs          int64             `json:"out_msgs"`
+	InBytes          int64             `json:"in_bytes"`
+	OutBytes         int64             `json:"out_bytes"`
+	SlowConsumers    int64             `json:"slow_consumers"`
+	Subscriptions    uint32            `json:"subscriptions"`
+	HTTPReqStats     map[string]uint64 `json:"http_req_stats"`
+}
+
+// Varz returns a Varz struct containing the server information.
+func (s *Server) Varz() *Varz {
+	// Snapshot server options.
+	opts := s.getOpts()
+
+	v := &Varz{Info: &Info{}, Options: opts, MaxPayload: opts.MaxPayload, Start: s.start}
+	v.Now = time.Now()
+	v.Uptime = myUptime(v.Now.Sub(s.start))
+	v.Port = opts.Port
+
+	pcpu, rss, err := procUsage(s.start)
+	if err != nil {
+		s.Errorf("Error getting process usage: %v", err)
+	}
+	v.Mem = rss
+	v.CPU = pcpu
+	v.Cores = runtime.NumCPU()
+
+	s.mu.Lock()
+	*v.Info = s.info
+	v.Connections = len(s.clients)
+	v.TotalConnections = s.totalClients
+	v.Routes = len(s.routes)
+	v.Remotes = len(s.remotes)
+	if s.profiler != nil {
+		v.ProfPort = s.profiler.Addr().(*net.TCPAddr).Port
+	}
+	v.HTTPReqStats = make(map[string]uint64, len(s.httpReqStats))
+	for k, n := range s.httpReqStats {
+		v.HTTPReqStats[k] = n
+	}
+	s.mu.Unlock()
+
+	v.InMsgs = atomic.LoadInt64(&s.inMsgs)
+	v.InBytes = atomic.LoadInt64(&s.inBytes)
+	v.OutMsgs = atomic.LoadInt64(&s.outMsgs)
+	v.OutBytes = atomic.LoadInt64(&s.outBytes)
+	v.SlowConsumers = atomic.LoadInt64(&s.slowConsumers)
+	v.Subscriptions = s.sl.Count()
+
+	return v
+}
+
+// HandleVarz will process HTTP requests for server information.
+func (s *Server) HandleVarz(w http.ResponseWriter, r *http.Request) {
+	s.countRequest(VarzPath)
+	v := s.Varz()
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /varz request: %v", err)
+	}
+	ResponseHandler(w, r, b)
+}
+
+// Connz represents detailed information on current client connections.
+type Connz struct {
+	Now      time.Time  `json:"now"`
+	NumConns int        `json:"num_connections"`
+	Total    int        `json:"total"`
+	Offset   int        `json:"offset"`
+	Limit    int        `json:"limit"`
+	Conns    []ConnInfo `json:"connections"`
+}
+
+// ConnzOptions are the options passed to Connz()
+type ConnzOptions struct {
+	// Sort indicates how the results will be sorted. Check SortOpt for possible values.
+	// Only the sort by connection ID (ByCid) is ascending, all others are descending.
+	Sort SortOpt `json:"sort"`
+
+	// Subscriptions indicates if subscriptions should be included in the results.
+	Subscriptions bool `json:"subscriptions"`
+
+	// Offset is used for pagination. Connz() only returns connections starting at this
+	// offset from the global results.
+	Offset int `json:"offset"`
+
+	// Limit is the maximum number of connections that should be returned by Connz().
+	Limit int `json:"limit"`
+}
+
+// ConnInfo has detailed information on a per connection basis.
+type ConnInfo struct {
+	Cid            uint64    `json:"cid"`
+	IP             string    `json:"ip"`
+	Port           int       `json:"port"`
+	Start          time.Time `json:"start"`
+	LastActivity   time.Time `json:"last_activity"`
+	Uptime         string    `json:"uptime"`
+	Idle           string    `json:"idle"`
+	Pending        int       `json:"pending_bytes"`
+	InMsgs         int64     `json:"in_msgs"`
+	OutMsgs        int64     `json:"out_msgs"`
+	InBytes        int64     `json:"in_bytes"`
+	OutBytes       int64     `json:"out_bytes"`
+	NumSubs        uint32    `json:"subscriptions"`
+	Name           string    `json:"name,omitempty"`
+	Lang           string    `json:"lang,omitempty"`
+	Version        string    `json:"version,omitempty"`
+	TLSVersion     string    `json:"tls_version,omitempty"`
+	TLSCipher      string    `json:"tls_cipher_suite,omitempty"`
+	AuthorizedUser string    `json:"authorized_user,omitempty"`
+	Subs           []string  `json:"subscriptions_list,omitempty"`
+}
+
+// SortOpt is a helper type to sort clients
+type SortOpt string
+
+// Possible sort options
+const (
+	ByCid      SortOpt = "cid"        // By connection ID
+	BySubs     SortOpt = "subs"       // By number of subscriptions
+	ByPending  SortOpt = "pending"    // By amount of data in bytes waiting to be sent to client
+	ByOutMsgs  SortOpt = "msgs_to"    // By number of messages sent
+	ByInMsgs   SortOpt = "msgs_from"  // By number of messages received
+	ByOutBytes SortOpt = "bytes_to"   // By amount of bytes sent
+	ByInBytes  SortOpt = "bytes_from" // By amount of bytes received
+	ByLast     SortOpt = "last"       // By the last activity
+	ByIdle     SortOpt = "idle"       // By the amount of inactivity
+	ByUptime   SortOpt = "uptime"     // By the amount of time connections exist
+)
+
+// IsValid determines if a sort option is valid
+func (s SortOpt) IsValid() bool {
+	switch s {
+	case "", ByCid, BySubs, ByPending, ByOutMsgs, ByInMsgs, ByOutBytes, ByInBytes, ByLast, ByIdle, ByUptime:
+		return true
+	default:
+		return false
+	}
+}
+
+// sortConns sorts the connections in place, only ByCid is ascending.
+func sortConns(conns []ConnInfo, sortOpt SortOpt, now time.Time) {
+	var less func(a, b *ConnInfo) bool
+	switch sortOpt {
+	case BySubs:
+		less = func(a, b *ConnInfo) bool { return a.NumSubs > b.NumSubs }
+	case ByPending:
+		less = func(a, b *ConnInfo) bool { return a.Pending > b.Pending }
+	case ByOutMsgs:
+		less = func(a, b *ConnInfo) bool { return a.OutMsgs > b.OutMsgs }
+	case ByInMsgs:
+		less = func(a, b *ConnInfo) bool { return a.InMsgs > b.InMsgs }
+	case ByOutBytes:
+		less = func(a, b *ConnInfo) bool { return a.OutBytes > b.OutBytes }
+	case ByInBytes:
+		less = func(a, b *ConnInfo) bool { return a.InBytes > b.InBytes }
+	case ByLast:
+		less = func(a, b *ConnInfo) bool { return a.LastActivity.After(b.LastActivity) }
+	case ByIdle:
+		less = func(a, b *ConnInfo) bool {
+			return now.Sub(a.LastActivity) > now.Sub(b.LastActivity)
+		}
+	case ByUptime:
+		less = func(a, b *ConnInfo) bool { return a.Start.Before(b.Start) }
+	default:
+		less = func(a, b *ConnInfo) bool { return a.Cid < b.Cid }
+	}
+	sort.SliceStable(conns, func(i, j int) bool { return less(&conns[i], &conns[j]) })
+}
+
+// Connz returns a Connz struct containing information about connections.
+func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
+	var (
+		sortOpt = ByCid
+		subs    bool
+		offset  int
+		limit   = DefaultConnListSize
+	)
+
+	if opts != nil {
+		// If no sort option given or sort is by uptime, then sort by cid
+		if opts.Sort != "" {
+			sortOpt = opts.Sort
+			if !sortOpt.IsValid() {
+				return nil, fmt.Errorf("Invalid sorting option: %s", sortOpt)
+			}
+		}
+		subs = opts.Subscriptions
+		offset = opts.Offset
+		if offset < 0 {
+			offset = 0
+		}
+		limit = opts.Limit
+		if limit <= 0 {
+			limit = DefaultConnListSize
+		}
+	}
+
+	c := &Connz{
+		Offset: offset,
+		Limit:  limit,
+		Now:    time.Now(),
+	}
+
+	// Walk the list
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	hasUsers := s.users != nil
+	s.mu.Unlock()
+
+	conns := make([]ConnInfo, 0, len(clients))
+	for _, client := range clients {
+		client.mu.Lock()
+		// The connection may have been closed since the snapshot.
+		if client.nc == nil {
+			client.mu.Unlock()
+			continue
+		}
+		ci := ConnInfo{
+			Cid:          client.cid,
+			Start:        client.start,
+			LastActivity: client.last,
+			Uptime:       myUptime(c.Now.Sub(client.start)),
+			Idle:         myUptime(c.Now.Sub(client.last)),
+			OutMsgs:      client.outMsgs,
+			OutBytes:     client.outBytes,
+			NumSubs:      uint32(len(client.subs)),
+			Pending:      client.bw.Buffered(),
+			Name:         client.opts.Name,
+			Lang:         client.opts.Lang,
+			Version:      client.opts.Version,
+		}
+		ci.InMsgs = atomic.LoadInt64(&client.inMsgs)
+		ci.InBytes = atomic.LoadInt64(&client.inBytes)
+		if hasUsers {
+			ci.AuthorizedUser = client.opts.Username
+		}
+		if ip, ok := client.nc.(*net.TCPConn); ok {
+			addr := ip.RemoteAddr().(*net.TCPAddr)
+			ci.Port = addr.Port
+			ci.IP = addr.IP.String()
+		} else if tlsConn, ok := client.nc.(*tls.Conn); ok {
+			if addr, ok := tlsConn.RemoteAddr().(*net.TCPAddr); ok {
+				ci.Port = addr.Port
+				ci.IP = addr.IP.String()
+			}
+			cs := tlsConn.ConnectionState()
+			ci.TLSVersion = tlsVersion(cs.Version)
+			ci.TLSCipher = tlsCipher(cs.CipherSuite)
+		}
+		if subs && len(client.subs) > 0 {
+			ci.Subs = make([]string, 0, len(client.subs))
+			for _, sub := range client.subs {
+				ci.Subs = append(ci.Subs, string(sub.subject))
+			}
+		}
+		client.mu.Unlock()
+		conns = append(conns, ci)
+	}
+
+	sortConns(conns, sortOpt, c.Now)
+
+	c.Total = len(conns)
+	minoff := c.Offset
+	maxoff := c.Offset + c.Limit
+
+	// Make sure these are sane.
+	if minoff > c.Total {
+		minoff = c.Total
+	}
+	if maxoff > c.Total {
+		maxoff = c.Total
+	}
+	c.Conns = conns[minoff:maxoff]
+	c.NumConns = len(c.Conns)
+
+	return c, nil
+}
+
+// HandleConnz process HTTP requests for connection information.
+func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
+	subs, err := decodeBool(w, r, "subs")
+	if err != nil {
+		return
+	}
+	offset, err := decodeInt(w, r, "offset")
+	if err != nil {
+		return
+	}
+	limit, err := decodeInt(w, r, "limit")
+	if err != nil {
+		return
+	}
+
+	connzOpts := &ConnzOptions{
+		Sort:          SortOpt(r.URL.Query().Get("sort")),
+		Subscriptions: subs,
+		Offset:        offset,
+		Limit:         limit,
+	}
+
+	s.countRequest(ConnzPath)
+
+	c, err := s.Connz(connzOpts)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /connz request: %v", err)
+	}
+	ResponseHandler(w, r, b)
+}
+
+// Routez represents detailed information on current routes.
+type Routez struct {
+	Now       time.Time    `json:"now"`
+	NumRoutes int          `json:"num_routes"`
+	Routes    []*RouteInfo `json:"routes"`
+}
+
+// RouteInfo has detailed information on a per connection basis.
+type RouteInfo struct {
+	Rid          uint64   `json:"rid"`
+	RemoteID     string   `json:"remote_id"`
+	DidSolicit   bool     `json:"did_solicit"`
+	IsConfigured bool     `json:"is_configured"`
+	IP           string   `json:"ip"`
+	Port         int      `json:"port"`
+	Pending      int      `json:"pending_size"`
+	InMsgs       int64    `json:"in_msgs"`
+	OutMsgs      int64    `json:"out_msgs"`
+	InBytes      int64    `json:"in_bytes"`
+	OutBytes     int64    `json:"out_bytes"`
+	NumSubs      uint32   `json:"subscriptions"`
+	Subs         []string `json:"subscriptions_list,omitempty"`
+}
+
+// Routez returns a Routez struct containing information about routes.
+func (s *Server) Routez(subs bool) *Routez {
+	rs := &Routez{Routes: []*RouteInfo{}}
+
+	s.mu.Lock()
+	routes := make([]*client, 0, len(s.routes))
+	for _, r := range s.routes {
+		routes = append(routes, r)
+	}
+	s.mu.Unlock()
+
+	// Walk the list
+	for _, r := range routes {
+		r.mu.Lock()
+		if r.route == nil {
+			r.mu.Unlock()
+			continue
+		}
+		ri := &RouteInfo{
+			Rid:          r.cid,
+			RemoteID:     r.route.remoteID,
+			DidSolicit:   r.route.didSolicit,
+			IsConfigured: r.route.routeType == Explicit,
+			InMsgs:       atomic.LoadInt64(&r.inMsgs),
+			OutMsgs:      r.outMsgs,
+			InBytes:      atomic.LoadInt64(&r.inBytes),
+			OutBytes:     r.outBytes,
+			NumSubs:      uint32(len(r.subs)),
+		}
+		if r.bw != nil {
+			ri.Pending = r.bw.Buffered()
+		}
+
+		if subs && len(r.subs) > 0 {
+			ri.Subs = make([]string, 0, len(r.subs))
+			for _, sub := range r.subs {
+				ri.Subs = append(ri.Subs, string(sub.subject))
+			}
+		}
+		if r.nc != nil {
+			if addr, ok := r.nc.RemoteAddr().(*net.TCPAddr); ok {
+				ri.Port = addr.Port
+				ri.IP = addr.IP.String()
+			}
+		}
+		r.mu.Unlock()
+		rs.Routes = append(rs.Routes, ri)
+	}
+	sort.Slice(rs.Routes, func(i, j int) bool { return rs.Routes[i].Rid < rs.Routes[j].Rid })
+	rs.NumRoutes = len(rs.Routes)
+	rs.Now = time.Now()
+	return rs
+}
+
+// HandleRoutez process HTTP requests for route information.
+func (s *Server) HandleRoutez(w http.ResponseWriter, r *http.Request) {
+	subs, err := decodeBool(w, r, "subs")
+	if err != nil {
+		return
+	}
+	s.countRequest(RoutezPath)
+
+	rs := s.Routez(subs)
+	b, err := json.MarshalIndent(rs, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /routez request: %v", err)
+	}
+	ResponseHandler(w, r, b)
+}
+
+// Subsz represents detail information on current connections.
+type Subsz struct {
+	*SublistStats
+}
+
+// HandleSubsz processes HTTP requests for subjects stats.
+func (s *Server) HandleSubsz(w http.ResponseWriter, r *http.Request) {
+	s.countRequest(SubszPath)
+
+	st := &Subsz{s.sl.Stats()}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /subscriptionsz request: %v", err)
+	}
+	ResponseHandler(w, r, b)
+}
+
+// HandleRoot will show basic info and links to others handlers.
+func (s *Server) HandleRoot(w http.ResponseWriter, r *http.Request) {
+	// This feels dumb to me, but is required: https://code.google.com/p/go/issues/detail?id=4799
+	if r.URL.Path != RootPath {
+		http.NotFound(w, r)
+		return
+	}
+	s.countRequest(RootPath)
+	fmt.Fprintf(w, `<html lang="en">
+   <head>
+    <style type="text/css">
+      body { font-family: "Century Gothic", CenturyGothic, AppleGothic, sans-serif; font-size: 22; }
+      a { margin-left: 32px; }
+    </style>
+  </head>
+  <body>
+    <a href=%s>varz</a><br/>
+    <a href=%s>connz</a><br/>
+    <a href=%s>routez</a><br/>
+    <a href=%s>subsz</a><br/>
+    <a href=%s>metrics</a><br/>
+  </body>
+</html>`, VarzPath, ConnzPath, RoutezPath, SubszPath, MetricsPath)
+}
+
+// ResponseHandler handles responses for monitoring routes, with
+// optional JSONP support through the callback query parameter.
+func ResponseHandler(w http.ResponseWriter, r *http.Request, data []byte) {
+	// Get callback from request
+	callback := r.URL.Query().Get("callback")
+	// If callback is not empty then
+	if callback != "" {
+		// Response for JSONP
+		w.Header().Set("Content-Type", "application/javascript")
+		fmt.Fprintf(w, "%s(%s)", callback, data)
+	} else {
+		// Otherwise JSON
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
+
+func decodeBool(w http.ResponseWriter, r *http.Request, param string) (bool, error) {
+	str := r.URL.Query().Get(param)
+	if str == "" {
+		return false, nil
+	}
+	val, err := strconv.ParseBool(str)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Error decoding boolean for '%s': %v", param, err)))
+		return false, err
+	}
+	return val, nil
+}
+
+func decodeInt(w http.ResponseWriter, r *http.Request, param string) (int, error) {
+	str := r.URL.Query().Get(param)
+	if str == "" {
+		return 0, nil
+	}
+	val, err := strconv.Atoi(str)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Error decoding int for '%s': %v", param, err)))
+		return 0, err
+	}
+	return val, nil
+}
+
+// myUptime formats a duration as e.g. 1d2h3m4s.
+func myUptime(d time.Duration) string {
+	// Just use total seconds for uptime, and display days / years
+	tsecs := d / time.Second
+	tmins := tsecs / 60
+	thrs := tmins / 60
+	tdays := thrs / 24
+	tyrs := tdays / 365
+
+	if tyrs > 0 {
+		return fmt.Sprintf("%dy%dd%dh%dm%ds", tyrs, tdays%365, thrs%24, tmins%60, tsecs%60)
+	}
+	if tdays > 0 {
+		return fmt.Sprintf("%dd%dh%dm%ds", tdays, thrs%24, tmins%60, tsecs%60)
+	}
+	if thrs > 0 {
+		return fmt.Sprintf("%dh%dm%ds", thrs, tmins%60, tsecs%60)
+	}
+	if tmins > 0 {
+		return fmt.Sprintf("%dm%ds", tmins, tsecs%60)
+	}
+	return fmt.Sprintf("%ds", tsecs)
+}
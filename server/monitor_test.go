@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readMonitorBody(t *testing.T, s *Server, path string) (int, []byte) {
+	url := fmt.Sprintf("http://%s%s", s.MonitorAddr(), path)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Could not get %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not read body of %s: %v", url, err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestMonitorBothPortsConfigured(t *testing.T) {
+	s := New(&Options{HTTPPort: 1, HTTPSPort: 2})
+	if err := s.StartMonitoring(); err == nil {
+		t.Fatal("Expected an error with both HTTP and HTTPS ports set")
+	}
+}
+
+func TestMonitorEndpoints(t *testing.T) {
+	s := runServer(t, &Options{HTTPPort: RANDOM_PORT})
+	defer s.Shutdown()
+
+	c := newTestConn(t, s)
+	defer c.close()
+	c.connect(`{"verbose":false,"name":"mon"}`)
+	c.send("SUB foo 1\r\nSUB bar 2\r\nPUB foo 2\r\nok\r\n")
+	c.expectMsg("foo", "1", "ok")
+	c.flush()
+
+	code, body := readMonitorBody(t, s, VarzPath)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	var v Varz
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("Could not unmarshal varz: %v", err)
+	}
+	if v.Connections != 1 || v.InMsgs != 1 || v.OutMsgs != 1 || v.Subscriptions != 2 {
+		t.Fatalf("Unexpected varz: connections=%d in=%d out=%d subs=%d",
+			v.Connections, v.InMsgs, v.OutMsgs, v.Subscriptions)
+	}
+	if v.HTTPReqStats[VarzPath] != 1 {
+		t.Fatalf("Expected 1 request to %s, got %d", VarzPath, v.HTTPReqStats[VarzPath])
+	}
+
+	_, body = readMonitorBody(t, s, ConnzPath+"?subs=1")
+	var cz Connz
+	if err := json.Unmarshal(body, &cz); err != nil {
+		t.Fatalf("Could not unmarshal connz: %v", err)
+	}
+	if cz.NumConns != 1 || cz.Total != 1 {
+		t.Fatalf("Expected 1 connection, got %d/%d", cz.NumConns, cz.Total)
+	}
+	ci := cz.Conns[0]
+	if ci.Name != "mon" || ci.NumSubs != 2 || len(ci.Subs) != 2 || ci.InMsgs != 1 || ci.IP != "127.0.0.1" {
+		t.Fatalf("Unexpected connection info: %+v", ci)
+	}
+
+	if code, _ := readMonitorBody(t, s, ConnzPath+"?sort=foo"); code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 for a bad sort option, got %d", code)
+	}
+	if code, _ := readMonitorBody(t, s, ConnzPath+"?offset=x"); code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 for a bad offset, got %d", code)
+	}
+	_, body = readMonitorBody(t, s, ConnzPath+"?offset=1")
+	cz = Connz{}
+	json.Unmarshal(body, &cz)
+	if cz.NumConns != 0 || cz.Total != 1 {
+		t.Fatalf("Expected no connections past the offset, got %d/%d", cz.NumConns, cz.Total)
+	}
+
+	_, body = readMonitorBody(t, s, RoutezPath)
+	var rz Routez
+	if err := json.Unmarshal(body, &rz); err != nil {
+		t.Fatalf("Could not unmarshal routez: %v", err)
+	}
+	if rz.NumRoutes != 0 {
+		t.Fatalf("Expected no routes, got %d", rz.NumRoutes)
+	}
+
+	_, body = readMonitorBody(t, s, SubszPath)
+	var sz Subsz
+	if err := json.Unmarshal(body, &sz); err != nil {
+		t.Fatalf("Could not unmarshal subsz: %v", err)
+	}
+	if sz.NumSubs != 2 {
+		t.Fatalf("Expected 2 subscriptions, got %d", sz.NumSubs)
+	}
+
+	if code, _ := readMonitorBody(t, s, "/nope"); code != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %d", code)
+	}
+}
+
+func TestSortConns(t *testing.T) {
+	now := time.Now()
+	conns := []ConnInfo{
+		{Cid: 2, NumSubs: 1, OutMsgs: 5, LastActivity: now.Add(-time.Second)},
+		{Cid: 1, NumSubs: 3, OutMsgs: 1, LastActivity: now.Add(-time.Minute)},
+		{Cid: 3, NumSubs: 2, OutMsgs: 9, LastActivity: now},
+	}
+	for _, tc := range []struct {
+		opt  SortOpt
+		cids []uint64
+	}{
+		{ByCid, []uint64{1, 2, 3}},
+		{BySubs, []uint64{1, 3, 2}},
+		{ByOutMsgs, []uint64{3, 2, 1}},
+		{ByLast, []uint64{3, 2, 1}},
+		{ByIdle, []uint64{1, 2, 3}},
+	} {
+		sortConns(conns, tc.opt, now)
+		for i, cid := range tc.cids {
+			if conns[i].Cid != cid {
+				t.Fatalf("Sort by %q: expected cid %d at %d, got %d", tc.opt, cid, i, conns[i].Cid)
+			}
+		}
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	// The profiler listens before the client port, runServer waits for both.
+	s := runServer(t, &Options{HTTPPort: RANDOM_PORT, ProfPort: RANDOM_PORT})
+	profAddr := s.ProfilerAddr()
+	if profAddr == nil {
+		t.Fatal("Profiler did not start listening")
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/debug/pprof/goroutine?debug=1", profAddr))
+	if err != nil {
+		t.Fatalf("Could not get goroutine profile: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine profile") {
+		t.Fatalf("Unexpected goroutine profile response %d: %q", resp.StatusCode, body)
+	}
+
+	_, body = readMonitorBody(t, s, VarzPath)
+	var v Varz
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("Could not unmarshal varz: %v", err)
+	}
+	if v.ProfPort != profAddr.Port {
+		t.Fatalf("Expected profiling port %d in varz, got %d", profAddr.Port, v.ProfPort)
+	}
+
+	s.Shutdown()
+	if s.ProfilerAddr() != nil {
+		t.Fatal("Expected profiler to be closed on shutdown")
+	}
+	if _, err := net.Dial("tcp", profAddr.String()); err == nil {
+		t.Fatal("Expected profiling port to be closed")
+	}
+}
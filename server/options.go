@@ -2,8 +2,16 @@ package server
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/impact-eintr/nats-server/conf"
 )
 
 type Options struct {
@@ -23,15 +31,29 @@ type Options struct {
 	MaxPingsOut  int           `json:"ping_max"`
 
 	MaxPayload int         `json:"max_payload"`
+	HTTPHost   string      `json:"http_host"`
+	HTTPPort   int         `json:"http_port"`
+	HTTPSPort  int         `json:"https_port"`
 	Cluster    ClusterOpts `json:"cluster"`
 	ProfPort   int         `json:"-"`
-	PidFile    string      `josn:"-"`
-	LogFile    string      `json:"-"`
-	Routes     []*url.URL  `json:"-"`
+	// 阻塞和锁竞争的采样率，参见runtime.SetBlockProfileRate和SetMutexProfileFraction
+	ProfBlockRate     int        `json:"-"`
+	ProfMutexFraction int        `json:"-"`
+	PidFile           string     `json:"-"`
+	LogFile           string     `json:"-"`
+	Logtime           bool       `json:"-"`
+	LogtimeSet        bool       `json:"-"` // -T/--logtime在命令行中显式给出
+	Syslog            bool       `json:"-"`
+	RemoteSyslog      string     `json:"-"`
+	NoSigs            bool       `json:"-"` // 不捕获进程信号，用于内嵌的服务器
+	Routes            []*url.URL `json:"-"`
 
-	TLS           bool          `json:-`
+	TLS           bool          `json:"-"`
 	TLSConfig     *tls.Config   `json:"-"`
 	WriteDeadline time.Duration `json:"-"`
+	MaxPending    int           `json:"max_pending_size"` // 每个客户端待发送字节的上限，超过则视为慢消费者
+
+	LameDuckDuration time.Duration `json:"-"` // 下线前关闭全部客户端所用的时间
 }
 
 type ClusterOpts struct {
@@ -44,5 +66,807 @@ type ClusterOpts struct {
 	TLSConfig      *tls.Config `json:"-"`
 	ListenStr      string      `json:"-"`
 	NoAdvertise    bool        `json:"-"` // 通知
-	ConnectRetries int         `json:-`   // 重连
+	ConnectRetries int         `json:"-"` // 重连
+}
+
+// TLSConfigOpts holds the parsed tls config information,
+// used with flag parsing
+type TLSConfigOpts struct {
+	CertFile string
+	KeyFile  string
+	CaFile   string
+	Verify   bool
+	Timeout  float64
+}
+
+// ProcessConfigFile processes a configuration file.
+func ProcessConfigFile(configFile string) (*Options, error) {
+	// Timestamps default to true, as on the command line.
+	opts := &Options{ConfigFile: configFile, Logtime: true}
+
+	if configFile == "" {
+		return opts, nil
+	}
+
+	m, positions, err := conf.ParseFileWithPositions(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range m {
+		if err := processConfigEntry(opts, k, v); err != nil {
+			return nil, positionError(positions, atKey(k, err))
+		}
+	}
+	return opts, nil
+}
+
+// processConfigEntry applies a top level entry of the configuration file.
+func processConfigEntry(opts *Options, k string, v interface{}) error {
+	var err error
+	switch strings.ToLower(k) {
+	case "listen":
+		hp, err := parseListen(v)
+		if err != nil {
+			return err
+		}
+		opts.Host = hp.host
+		opts.Port = hp.port
+	case "port":
+		if opts.Port, err = intValue(k, v); err != nil {
+			return err
+		}
+	case "host", "net":
+		if opts.Host, err = stringValue(k, v); err != nil {
+			return err
+		}
+	case "debug":
+		if opts.Debug, err = boolValue(k, v); err != nil {
+			return err
+		}
+	case "trace":
+		if opts.Trace, err = boolValue(k, v); err != nil {
+			return err
+		}
+	case "logtime":
+		if opts.Logtime, err = boolValue(k, v); err != nil {
+			return err
+		}
+	case "syslog":
+		if opts.Syslog, err = boolValue(k, v); err != nil {
+			return err
+		}
+	case "remote_syslog":
+		if opts.RemoteSyslog, err = stringValue(k, v); err != nil {
+			return err
+		}
+	case "log_file", "logfile":
+		if opts.LogFile, err = stringValue(k, v); err != nil {
+			return err
+		}
+	case "pid_file", "pidfile":
+		if opts.PidFile, err = stringValue(k, v); err != nil {
+			return err
+		}
+	case "http":
+		hp, err := parseListen(v)
+		if err != nil {
+			return err
+		}
+		opts.HTTPHost = hp.host
+		opts.HTTPPort = hp.port
+	case "https":
+		hp, err := parseListen(v)
+		if err != nil {
+			return err
+		}
+		opts.HTTPHost = hp.host
+		opts.HTTPSPort = hp.port
+	case "http_port", "monitor_port":
+		if opts.HTTPPort, err = intValue(k, v); err != nil {
+			return err
+		}
+	case "https_port":
+		if opts.HTTPSPort, err = intValue(k, v); err != nil {
+			return err
+		}
+	case "prof_port":
+		if opts.ProfPort, err = intValue(k, v); err != nil {
+			return err
+		}
+	case "prof_block_rate":
+		if opts.ProfBlockRate, err = intValue(k, v); err != nil {
+			return err
+		}
+	case "prof_mutex_fraction":
+		if opts.ProfMutexFraction, err = intValue(k, v); err != nil {
+			return err
+		}
+	case "max_connections", "max_conn":
+		if opts.MaxConn, err = intValue(k, v); err != nil {
+			return err
+		}
+	case "max_payload":
+		if opts.MaxPayload, err = sizeValue(k, v); err != nil {
+			return err
+		}
+	case "ping_interval":
+		if opts.PingInterval, err = durationValue(k, v); err != nil {
+			return err
+		}
+	case "ping_max":
+		if opts.MaxPingsOut, err = intValue(k, v); err != nil {
+			return err
+		}
+	case "max_pending", "max_pending_size":
+		if opts.MaxPending, err = sizeValue(k, v); err != nil {
+			return err
+		}
+	case "write_deadline":
+		if opts.WriteDeadline, err = durationValue(k, v); err != nil {
+			return err
+		}
+	case "lame_duck_duration":
+		if opts.LameDuckDuration, err = durationValue(k, v); err != nil {
+			return err
+		}
+		if opts.LameDuckDuration <= 0 {
+			return fmt.Errorf("Expected %s to be positive, got %v", k, opts.LameDuckDuration)
+		}
+	case "authorization":
+		am, err := mapValue(k, v)
+		if err != nil {
+			return err
+		}
+		auth, err := parseAuthorization(am)
+		if err != nil {
+			return err
+		}
+		opts.Username = auth.user
+		opts.Password = auth.pass
+		opts.Authorization = auth.token
+		if (auth.user != "" || auth.pass != "") && auth.token != "" {
+			return fmt.Errorf("Cannot have a user/pass and token")
+		}
+		// Check for multiple users defined
+		if auth.users != nil {
+			if auth.user != "" {
+				return fmt.Errorf("Can not have a single user/pass and a users array")
+			}
+			if auth.token != "" {
+				return fmt.Errorf("Can not have a token and a users array")
+			}
+			opts.Users = auth.users
+		}
+	case "cluster":
+		cm, err := mapValue(k, v)
+		if err != nil {
+			return err
+		}
+		if err := parseCluster(cm, opts); err != nil {
+			return err
+		}
+	case "tls":
+		tm, err := mapValue(k, v)
+		if err != nil {
+			return err
+		}
+		tc, err := parseTLS(tm)
+		if err != nil {
+			return err
+		}
+		if opts.TLSConfig, err = GenTLSConfig(tc); err != nil {
+			return err
+		}
+		opts.TLS = true
+	}
+	return nil
+}
+
+// hostPort is the result of parsing a listen directive.
+type hostPort struct {
+	host string
+	port int
+}
+
+// parseListen parses a "host:port" or ":port" string, or a bare port.
+func parseListen(v interface{}) (*hostPort, error) {
+	hp := &hostPort{}
+	switch vv := v.(type) {
+	// Only a port
+	case int64:
+		hp.port = int(vv)
+	case string:
+		host, port, err := net.SplitHostPort(vv)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse address string %q", vv)
+		}
+		hp.port, err = strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse port %q", port)
+		}
+		hp.host = host
+	default:
+		return nil, fmt.Errorf("Expected port or host:port, got %T", vv)
+	}
+	return hp, nil
+}
+
+// parseCluster will parse the cluster config.
+func parseCluster(cm map[string]interface{}, opts *Options) error {
+	var err error
+	for mk, mv := range cm {
+		switch strings.ToLower(mk) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				return atKey(mk, err)
+			}
+			opts.Cluster.Host = hp.host
+			opts.Cluster.Port = hp.port
+		case "port":
+			if opts.Cluster.Port, err = intValue(mk, mv); err != nil {
+				return atKey(mk, err)
+			}
+		case "host", "net":
+			if opts.Cluster.Host, err = stringValue(mk, mv); err != nil {
+				return atKey(mk, err)
+			}
+		case "authorization":
+			am, err := mapValue(mk, mv)
+			if err != nil {
+				return atKey(mk, err)
+			}
+			auth, err := parseAuthorization(am)
+			if err != nil {
+				return atKey(mk, err)
+			}
+			if auth.users != nil {
+				return atKey(mk, fmt.Errorf("Cluster authorization does not allow multiple users"))
+			}
+			opts.Cluster.Username = auth.user
+			opts.Cluster.Password = auth.pass
+			opts.Cluster.AuthTimeout = auth.timeout
+		case "routes":
+			ra, err := arrayValue(mk, mv)
+			if err != nil {
+				return atKey(mk, err)
+			}
+			opts.Routes = make([]*url.URL, 0, len(ra))
+			for i, r := range ra {
+				rs, err := stringValue(mk, r)
+				if err != nil {
+					return atKey(mk, atKey(strconv.Itoa(i), err))
+				}
+				url, err := url.Parse(rs)
+				if err != nil {
+					return atKey(mk, atKey(strconv.Itoa(i), fmt.Errorf("error parsing route url [%q]", rs)))
+				}
+				opts.Routes = append(opts.Routes, url)
+			}
+		case "no_advertise":
+			if opts.Cluster.NoAdvertise, err = boolValue(mk, mv); err != nil {
+				return atKey(mk, err)
+			}
+		case "connect_retries":
+			if opts.Cluster.ConnectRetries, err = intValue(mk, mv); err != nil {
+				return atKey(mk, err)
+			}
+		case "tls":
+			tm, err := mapValue(mk, mv)
+			if err != nil {
+				return atKey(mk, err)
+			}
+			tc, err := parseTLS(tm)
+			if err != nil {
+				return atKey(mk, err)
+			}
+			if opts.Cluster.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				return atKey(mk, err)
+			}
+			// For clusters, we will force strict verification. We also act
+			// as both client and server, so will mirror the rootCA to the
+			// clientCA pool.
+			opts.Cluster.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			opts.Cluster.TLSConfig.RootCAs = opts.Cluster.TLSConfig.ClientCAs
+			opts.Cluster.TLSTimeout = tc.Timeout
+		}
+	}
+	return nil
+}
+
+// authorization holds the parsed content of an authorization block.
+type authorization struct {
+	// Singles
+	user  string
+	pass  string
+	token string
+	// Multiple Users
+	users   []*User
+	timeout float64
+}
+
+// parseAuthorization will parse the authorization config.
+func parseAuthorization(am map[string]interface{}) (*authorization, error) {
+	var err error
+	auth := &authorization{}
+	for mk, mv := range am {
+		switch strings.ToLower(mk) {
+		case "user", "username":
+			if auth.user, err = stringValue(mk, mv); err != nil {
+				return nil, atKey(mk, err)
+			}
+		case "pass", "password":
+			if auth.pass, err = stringValue(mk, mv); err != nil {
+				return nil, atKey(mk, err)
+			}
+		case "token":
+			if auth.token, err = stringValue(mk, mv); err != nil {
+				return nil, atKey(mk, err)
+			}
+		case "timeout":
+			if auth.timeout, err = floatValue(mk, mv); err != nil {
+				return nil, atKey(mk, err)
+			}
+		case "users":
+			if auth.users, err = parseUsers(mv); err != nil {
+				return nil, atKey(mk, err)
+			}
+		}
+	}
+	return auth, nil
+}
+
+// parseUsers parses the users array of an authorization block.
+func parseUsers(mv interface{}) ([]*User, error) {
+	// Make sure we have an array
+	uv, err := arrayValue("users", mv)
+	if err != nil {
+		return nil, err
+	}
+	users := []*User{}
+	for i, u := range uv {
+		idx := strconv.Itoa(i)
+		// Check its a map/struct
+		um, err := mapValue("user", u)
+		if err != nil {
+			return nil, atKey(idx, err)
+		}
+		user := &User{}
+		for k, v := range um {
+			switch strings.ToLower(k) {
+			case "user", "username":
+				if user.Username, err = stringValue(k, v); err != nil {
+					return nil, atKey(idx, atKey(k, err))
+				}
+			case "pass", "password":
+				if user.Password, err = stringValue(k, v); err != nil {
+					return nil, atKey(idx, atKey(k, err))
+				}
+			case "permission", "permissions":
+				pm, err := mapValue(k, v)
+				if err != nil {
+					return nil, atKey(idx, atKey(k, err))
+				}
+				if user.Permissions, err = parseUserPermissions(pm); err != nil {
+					return nil, atKey(idx, atKey(k, err))
+				}
+			}
+		}
+		// Check to make sure we have at least a username
+		if user.Username == "" {
+			return nil, atKey(idx, fmt.Errorf("User entry requires a user"))
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// parseUserPermissions parses the publish and subscribe permissions of a user.
+func parseUserPermissions(pm map[string]interface{}) (*Permissions, error) {
+	p := &Permissions{}
+	for k, v := range pm {
+		var err error
+		switch strings.ToLower(k) {
+		case "pub", "publish":
+			if p.Publish, err = parseSubjectPermission(k, v); err != nil {
+				return nil, atKey(k, err)
+			}
+		case "sub", "subscribe":
+			if p.Subscribe, err = parseSubjectPermission(k, v); err != nil {
+				return nil, atKey(k, err)
+			}
+		default:
+			return nil, atKey(k, fmt.Errorf("Unknown field %q parsing permissions", k))
+		}
+	}
+	return p, nil
+}
+
+// parseSubjectPermission accepts a single subject, an array of subjects,
+// both meaning allow, or a map with allow and deny lists.
+func parseSubjectPermission(k string, v interface{}) (*SubjectPermission, error) {
+	sp := &SubjectPermission{}
+	if m, ok := v.(map[string]interface{}); ok {
+		for mk, mv := range m {
+			var err error
+			switch strings.ToLower(mk) {
+			case "allow":
+				if sp.Allow, err = parseSubjects(mk, mv); err != nil {
+					return nil, atKey(mk, err)
+				}
+			case "deny":
+				if sp.Deny, err = parseSubjects(mk, mv); err != nil {
+					return nil, atKey(mk, err)
+				}
+			default:
+				return nil, atKey(mk, fmt.Errorf("Unknown field %q parsing %s permissions", mk, k))
+			}
+		}
+		return sp, nil
+	}
+	allow, err := parseSubjects(k, v)
+	if err != nil {
+		return nil, err
+	}
+	sp.Allow = allow
+	return sp, nil
+}
+
+// parseSubjects parses a subject or an array of subjects.
+func parseSubjects(k string, v interface{}) ([]string, error) {
+	var subjects []string
+	switch vv := v.(type) {
+	case string:
+		subjects = append(subjects, vv)
+	case []interface{}:
+		for i, sv := range vv {
+			subject, err := stringValue(k, sv)
+			if err != nil {
+				return nil, atKey(strconv.Itoa(i), err)
+			}
+			subjects = append(subjects, subject)
+		}
+	default:
+		return nil, fmt.Errorf("Expected %s to be a subject or an array of subjects, got %T", k, v)
+	}
+	for _, subject := range subjects {
+		if !IsValidSubject(subject) {
+			return nil, fmt.Errorf("Invalid subject %q in %s permissions", subject, k)
+		}
+	}
+	return subjects, nil
+}
+
+// parseTLS parses the tls config.
+func parseTLS(tlsm map[string]interface{}) (*TLSConfigOpts, error) {
+	var err error
+	tc := TLSConfigOpts{}
+	for mk, mv := range tlsm {
+		switch strings.ToLower(mk) {
+		case "cert_file":
+			if tc.CertFile, err = stringValue(mk, mv); err != nil {
+				return nil, atKey(mk, err)
+			}
+		case "key_file":
+			if tc.KeyFile, err = stringValue(mk, mv); err != nil {
+				return nil, atKey(mk, err)
+			}
+		case "ca_file":
+			if tc.CaFile, err = stringValue(mk, mv); err != nil {
+				return nil, atKey(mk, err)
+			}
+		case "verify":
+			if tc.Verify, err = boolValue(mk, mv); err != nil {
+				return nil, atKey(mk, err)
+			}
+		case "timeout":
+			if tc.Timeout, err = floatValue(mk, mv); err != nil {
+				return nil, atKey(mk, err)
+			}
+		default:
+			return nil, atKey(mk, fmt.Errorf("error parsing tls config, unknown field [%q]", mk))
+		}
+	}
+	return &tc, nil
+}
+
+// GenTLSConfig loads TLS related configuration parameters.
+func GenTLSConfig(tc *TLSConfigOpts) (*tls.Config, error) {
+	// Now load in cert and private key
+	cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing X509 certificate/key pair: %v", err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate: %v", err)
+	}
+
+	// Create TLSConfig
+	// We will determine the cipher suites that we prefer.
+	config := tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		PreferServerCipherSuites: true,
+		MinVersion:               tls.VersionTLS12,
+	}
+
+	// Require client certificates as needed
+	if tc.Verify {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	// Add in CAs if applicable.
+	if tc.CaFile != "" {
+		rootPEM, err := ioutil.ReadFile(tc.CaFile)
+		if err != nil || rootPEM == nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		ok := pool.AppendCertsFromPEM(rootPEM)
+		if !ok {
+			return nil, fmt.Errorf("failed to parse root ca certificate")
+		}
+		config.ClientCAs = pool
+	}
+
+	return &config, nil
+}
+
+// configError is an error processing the value at path in the
+// configuration file, path being the keys and array indexes leading to it.
+type configError struct {
+	path []string
+	err  error
+}
+
+func (e *configError) Error() string {
+	return e.err.Error()
+}
+
+// atKey records that err happened processing the value of key k, or of
+// element k of an array, prepending k to the path of nested errors.
+func atKey(k string, err error) error {
+	if ce, ok := err.(*configError); ok {
+		ce.path = append([]string{k}, ce.path...)
+		return ce
+	}
+	return &configError{path: []string{k}, err: err}
+}
+
+// positionError prefixes err with the position of the offending value,
+// or of its closest enclosing value that has one.
+func positionError(positions conf.Positions, err error) error {
+	ce, ok := err.(*configError)
+	if !ok {
+		return err
+	}
+	for n := len(ce.path); n > 0; n-- {
+		if at, ok := positions.Lookup(ce.path[:n]...); ok {
+			return fmt.Errorf("%s: %v", at, ce.err)
+		}
+	}
+	return ce.err
+}
+
+// Value helpers, the parser hands out int64, float64, bool, string,
+// []interface{} and map[string]interface{}.
+
+func stringValue(k string, v interface{}) (string, error) {
+	switch vv := v.(type) {
+	case string:
+		return vv, nil
+	case int64:
+		return strconv.FormatInt(vv, 10), nil
+	}
+	return "", fmt.Errorf("Expected %s to be a string, got %T", k, v)
+}
+
+func intValue(k string, v interface{}) (int, error) {
+	if i, ok := v.(int64); ok {
+		return int(i), nil
+	}
+	return 0, fmt.Errorf("Expected %s to be an integer, got %T", k, v)
+}
+
+func floatValue(k string, v interface{}) (float64, error) {
+	switch vv := v.(type) {
+	case int64:
+		return float64(vv), nil
+	case float64:
+		return vv, nil
+	}
+	return 0, fmt.Errorf("Expected %s to be a number, got %T", k, v)
+}
+
+func boolValue(k string, v interface{}) (bool, error) {
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	return false, fmt.Errorf("Expected %s to be a boolean, got %T", k, v)
+}
+
+func mapValue(k string, v interface{}) (map[string]interface{}, error) {
+	if m, ok := v.(map[string]interface{}); ok {
+		return m, nil
+	}
+	return nil, fmt.Errorf("Expected %s to be a map, got %T", k, v)
+}
+
+func arrayValue(k string, v interface{}) ([]interface{}, error) {
+	if a, ok := v.([]interface{}); ok {
+		return a, nil
+	}
+	return nil, fmt.Errorf("Expected %s to be an array, got %T", k, v)
+}
+
+// durationValue accepts a number of seconds or a Go duration string
+// such as "2m" or "1m30s".
+func durationValue(k string, v interface{}) (time.Duration, error) {
+	switch vv := v.(type) {
+	case int64:
+		return time.Duration(vv) * time.Second, nil
+	case float64:
+		return secondsToDuration(vv), nil
+	case string:
+		d, err := time.ParseDuration(vv)
+		if err != nil {
+			return 0, fmt.Errorf("error parsing %s: %v", k, err)
+		}
+		return d, nil
+	}
+	return 0, fmt.Errorf("Expected %s to be a duration, got %T", k, v)
+}
+
+// sizeValue accepts a number of bytes or a size with a K, KB, M, MB, G
+// or GB suffix, e.g. "1MB".
+func sizeValue(k string, v interface{}) (int, error) {
+	switch vv := v.(type) {
+	case int64:
+		return int(vv), nil
+	case string:
+		s := strings.ToUpper(strings.TrimSpace(vv))
+		s = strings.TrimSuffix(s, "B")
+		mult := 1
+		switch {
+		case strings.HasSuffix(s, "K"):
+			mult = 1024
+		case strings.HasSuffix(s, "M"):
+			mult = 1024 * 1024
+		case strings.HasSuffix(s, "G"):
+			mult = 1024 * 1024 * 1024
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("error parsing %s: invalid size %q", k, vv)
+		}
+		return n * mult, nil
+	}
+	return 0, fmt.Errorf("Expected %s to be a size, got %T", k, v)
+}
+
+// MergeOptions will merge two options giving preference to the flagOpts
+// if the item is present.
+func MergeOptions(fileOpts, flagOpts *Options) *Options {
+	if fileOpts == nil {
+		return flagOpts
+	}
+	if flagOpts == nil {
+		return fileOpts
+	}
+	// Merge the two, flagOpts override
+	opts := *fileOpts
+
+	if flagOpts.Port != 0 {
+		opts.Port = flagOpts.Port
+	}
+	if flagOpts.Host != "" {
+		opts.Host = flagOpts.Host
+	}
+	if flagOpts.Username != "" {
+		opts.Username = flagOpts.Username
+	}
+	if flagOpts.Password != "" {
+		opts.Password = flagOpts.Password
+	}
+	if flagOpts.Authorization != "" {
+		opts.Authorization = flagOpts.Authorization
+	}
+	if flagOpts.Debug {
+		opts.Debug = true
+	}
+	if flagOpts.Trace {
+		opts.Trace = true
+	}
+	// Logtime defaults to true, so only an explicit flag overrides the file.
+	if flagOpts.LogtimeSet {
+		opts.Logtime = flagOpts.Logtime
+		opts.LogtimeSet = true
+	}
+	if flagOpts.LogFile != "" {
+		opts.LogFile = flagOpts.LogFile
+	}
+	if flagOpts.PidFile != "" {
+		opts.PidFile = flagOpts.PidFile
+	}
+	if flagOpts.Syslog {
+		opts.Syslog = true
+	}
+	if flagOpts.RemoteSyslog != "" {
+		opts.RemoteSyslog = flagOpts.RemoteSyslog
+	}
+	if flagOpts.HTTPPort != 0 {
+		opts.HTTPPort = flagOpts.HTTPPort
+	}
+	if flagOpts.HTTPSPort != 0 {
+		opts.HTTPSPort = flagOpts.HTTPSPort
+	}
+	if flagOpts.ProfPort != 0 {
+		opts.ProfPort = flagOpts.ProfPort
+	}
+	if flagOpts.TLSConfig != nil {
+		opts.TLS = true
+		opts.TLSConfig = flagOpts.TLSConfig
+	}
+	if flagOpts.Cluster.ListenStr != "" {
+		opts.Cluster.ListenStr = flagOpts.Cluster.ListenStr
+		opts.Cluster.Host = flagOpts.Cluster.Host
+		opts.Cluster.Port = flagOpts.Cluster.Port
+		if flagOpts.Cluster.Username != "" {
+			opts.Cluster.Username = flagOpts.Cluster.Username
+			opts.Cluster.Password = flagOpts.Cluster.Password
+		}
+	}
+	if flagOpts.Cluster.NoAdvertise {
+		opts.Cluster.NoAdvertise = true
+	}
+	if flagOpts.Cluster.ConnectRetries != 0 {
+		opts.Cluster.ConnectRetries = flagOpts.Cluster.ConnectRetries
+	}
+	if len(flagOpts.Routes) > 0 {
+		opts.Routes = flagOpts.Routes
+	}
+	return &opts
+}
+
+// processOptions fills in the defaults from const.go for anything
+// that was left unset.
+func processOptions(opts *Options) {
+	// Setup non-standard Go defaults
+	if opts.Host == "" {
+		opts.Host = DEFAULT_HOST
+	}
+	if opts.Port == 0 {
+		opts.Port = DEFAULT_PORT
+	} else if opts.Port == RANDOM_PORT {
+		// Choose randomly inside of net.Listen
+		opts.Port = 0
+	}
+	if opts.HTTPHost == "" {
+		// Default to same bind from server if left undefined
+		opts.HTTPHost = opts.Host
+	}
+	if opts.MaxConn == 0 {
+		opts.MaxConn = DEFAULT_MAX_CONNECTIONS
+	}
+	if opts.PingInterval == 0 {
+		opts.PingInterval = DEFAULT_PING_INTERVAL
+	}
+	if opts.MaxPingsOut == 0 {
+		opts.MaxPingsOut = DEFAULT_PING_MAX_OUT
+	}
+	if opts.MaxPayload == 0 {
+		opts.MaxPayload = MAX_PAYLOAD_SIZE
+	}
+	if opts.WriteDeadline == time.Duration(0) {
+		opts.WriteDeadline = DEFAULT_FLUSH_DEADLINE
+	}
+	if opts.MaxPending == 0 {
+		opts.MaxPending = MAX_PENDING_SIZE
+	}
+	if opts.LameDuckDuration <= time.Duration(0) {
+		opts.LameDuckDuration = DEFAULT_LAME_DUCK_DURATION
+	}
 }
@@ -429,7 +429,7 @@ func (c *client) parse(buf []byte) error {
 				// 如果我们没有保存的缓冲区，则继续使用索引。
 				// 如果这超出了剩下的内容，我们就会退出并处理拆分缓冲区。
 				if c.msgBuf == nil {
-					// TODO
+					i = c.as + c.pa.size - LEN_CR_LF
 				}
 			default:
 				if c.argBuf != nil {
@@ -485,14 +485,63 @@ func (c *client) parse(buf []byte) error {
 
 				// jump ahead with the index. If this overruns(泛滥成灾 超过)
 				// what is left we fall out and process split buffer.
-				// TODO
-				i = c.as + c.pa.size - 1
+				if c.msgBuf == nil {
+					i = c.as + c.pa.size - LEN_CR_LF
+				}
 			default:
 				if c.argBuf != nil {
 					c.argBuf = append(c.argBuf, b)
 				}
 			}
 
+		// 处理PUB/MSG的消息体，消息体长度由pa.size给出，以\r\n结尾
+		case MSG_PAYLOAD:
+			if c.msgBuf != nil {
+				// copy as much as we can to the buffer and skip ahead.
+				toCopy := c.pa.size - len(c.msgBuf)
+				avail := len(buf) - i
+				if avail < toCopy {
+					toCopy = avail
+				}
+				if toCopy > 0 {
+					start := len(c.msgBuf)
+					// This is needed for copy to work.
+					c.msgBuf = c.msgBuf[:start+toCopy]
+					copy(c.msgBuf[start:], buf[i:i+toCopy])
+					// Update our index
+					i = (i + toCopy) - 1
+				} else {
+					// Fall back to append if needed.
+					c.msgBuf = append(c.msgBuf, b)
+				}
+				if len(c.msgBuf) >= c.pa.size {
+					c.state = MSG_END
+				}
+			} else if i-c.as >= c.pa.size {
+				c.state = MSG_END
+			}
+		case MSG_END:
+			switch b {
+			case '\n':
+				if c.msgBuf != nil {
+					c.msgBuf = append(c.msgBuf, b)
+				} else {
+					c.msgBuf = buf[c.as : i+1]
+				}
+				// strict check for proto
+				if len(c.msgBuf) != c.pa.size+LEN_CR_LF {
+					goto parseErr
+				}
+				c.processMsg(c.msgBuf)
+				c.argBuf, c.msgBuf = nil, nil
+				c.drop, c.as, c.state = 0, i+1, OP_START
+			default:
+				if c.msgBuf != nil {
+					c.msgBuf = append(c.msgBuf, b)
+				}
+				continue
+			}
+
 		// 处理 PING 命令 PING keep-alive 消息 S <- -> C
 		case OP_PI:
 			switch b {
@@ -618,16 +667,101 @@ func (c *client) parse(buf []byte) error {
 	}
 
 	// 循环结束
+
+	// Check for split buffer scenarios for any ARG state.
+	// 一次Read可能只读到了半条协议，这里把参数保存下来等待下一次Read。
+	if c.state == SUB_ARG || c.state == UNSUB_ARG || c.state == PUB_ARG ||
+		c.state == MSG_ARG || c.state == MINUS_ERR_ARG ||
+		c.state == CONNECT_ARG || c.state == INFO_ARG {
+		// Setup a holder buffer to deal with split buffer scenario.
+		if c.argBuf == nil {
+			c.argBuf = c.scratch[:0]
+			c.argBuf = append(c.argBuf, buf[c.as:i-c.drop]...)
+		}
+		// Check for violations of control line length here. Note that this is not
+		// exact at all but the performance hit is too great to be precise, and
+		// catching here should prevent memory exhaustion attacks.
+		if len(c.argBuf) > MAX_CONTROL_LINE_SIZE {
+			c.sendErr("Maximum Control Line Exceeded")
+			c.closeConnection()
+			return ErrMaxControlLine
+		}
+	}
+
+	// Check for split msg
+	if (c.state == MSG_PAYLOAD || c.state == MSG_END) && c.msgBuf == nil {
+		// We need to clone the pubArg if it is still referencing the
+		// read buffer and we are not able to process the msg.
+		if c.argBuf == nil {
+			// Works also for MSG_ARG, when message comes from ROUTE.
+			c.clonePubArg()
+		}
+
+		// If we will overflow the scratch buffer, just create a
+		// new buffer to hold the split message.
+		if c.pa.size > cap(c.scratch)-len(c.argBuf) {
+			lrem := len(buf[c.as:])
+
+			// Consider it a protocol error when the remaining payload
+			// is larger than the reported size for PUB. It can happen
+			// when processing incomplete messages from rogue clients.
+			if lrem > c.pa.size+LEN_CR_LF {
+				goto parseErr
+			}
+			c.msgBuf = make([]byte, lrem, c.pa.size+LEN_CR_LF)
+			copy(c.msgBuf, buf[c.as:])
+		} else {
+			c.msgBuf = c.scratch[len(c.argBuf):len(c.argBuf)]
+			c.msgBuf = append(c.msgBuf, (buf[c.as:])...)
+		}
+	}
+
 	return nil
 authErr:
 	c.authViolation()
 	return ErrAuthorization
 
 parseErr:
-	s.sendErr("Unknown Protocol Operation")
+	c.sendErr("Unknown Protocol Operation")
 	snip := protoSnippet(i, buf)
 	err := fmt.Errorf("%s Parser ERROR, state=%d, i=%d: proto='%s...'",
 		c.typeString(), c.state, i, snip)
 	return err
 
 }
+
+func protoSnippet(start int, buf []byte) string {
+	stop := start + PROTO_SNIPPET_SIZE
+	bufSize := len(buf)
+	if start >= bufSize {
+		return `""`
+	}
+	if stop > bufSize {
+		stop = bufSize - 1
+	}
+	return fmt.Sprintf("%q", buf[start:stop])
+}
+
+// clonePubArg is used when the split buffer scenario has the pubArg in the existing read buffer, but
+// we need to hold onto it into the next read.
+func (c *client) clonePubArg() {
+	c.argBuf = c.scratch[:0]
+	c.argBuf = append(c.argBuf, c.pa.subject...)
+	c.argBuf = append(c.argBuf, c.pa.reply...)
+	c.argBuf = append(c.argBuf, c.pa.sid...)
+	c.argBuf = append(c.argBuf, c.pa.azb...)
+
+	if c.pa.subject != nil {
+		c.pa.subject = c.argBuf[:len(c.pa.subject)]
+	}
+
+	if c.pa.reply != nil {
+		c.pa.reply = c.argBuf[len(c.pa.subject) : len(c.pa.subject)+len(c.pa.reply)]
+	}
+
+	if c.pa.sid != nil {
+		c.pa.sid = c.argBuf[len(c.pa.subject)+len(c.pa.reply) : len(c.pa.subject)+len(c.pa.reply)+len(c.pa.sid)]
+	}
+
+	c.pa.azb = c.argBuf[len(c.pa.subject)+len(c.pa.reply)+len(c.pa.sid):]
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// Linux默认的时钟频率，/proc/self/stat里的CPU时间以它为单位
+const clockTicks = 100
+
+var pageSize = int64(os.Getpagesize())
+
+// procUsage returns the percent cpu and resident memory (in bytes) of the
+// running process. It reads /proc/self/stat when available and otherwise
+// falls back to the Go runtime memory statistics.
+func procUsage(start time.Time) (pcpu float64, rss int64, err error) {
+	contents, err := ioutil.ReadFile("/proc/self/stat")
+	if err != nil {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		return 0, int64(ms.Sys), nil
+	}
+
+	// The command name may contain spaces, skip past its closing paren.
+	if i := bytes.LastIndexByte(contents, ')'); i >= 0 {
+		contents = contents[i+1:]
+	}
+	fields := bytes.Fields(contents)
+	// utime, stime and rss are fields 14, 15 and 24 of the stat line,
+	// index 0 here is the state, field 3.
+	if len(fields) < 22 {
+		return 0, 0, fmt.Errorf("unexpected /proc/self/stat format")
+	}
+	utime, err := strconv.ParseInt(string(fields[11]), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	stime, err := strconv.ParseInt(string(fields[12]), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	pages, err := strconv.ParseInt(string(fields[21]), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	total := float64(utime+stime) / clockTicks
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		pcpu = total / elapsed * 100
+	}
+	return pcpu, pages * pageSize, nil
+}
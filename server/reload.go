@@ -0,0 +1,498 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// FlagSnapshot captures the server options as specified by CLI flags at
+// startup. Those take precedence over the configuration file on reload.
+var FlagSnapshot *Options
+
+// option is a hot-swappable configuration setting.
+type option interface {
+	// Apply the server option.
+	Apply(server *Server)
+
+	// IsLoggingChange indicates if this option requires reloading the logger.
+	IsLoggingChange() bool
+
+	// IsAuthChange indicates if this option requires reloading authorization.
+	IsAuthChange() bool
+}
+
+// noopOption is a base struct that provides default no-op behaviors.
+type noopOption struct{}
+
+func (n noopOption) IsLoggingChange() bool {
+	return false
+}
+
+func (n noopOption) IsAuthChange() bool {
+	return false
+}
+
+// loggingOption is a base struct that provides default option behaviors for
+// logging-related options.
+type loggingOption struct {
+	noopOption
+}
+
+func (l loggingOption) IsLoggingChange() bool {
+	return true
+}
+
+// traceOption implements the option interface for the `trace` setting.
+type traceOption struct {
+	loggingOption
+	newValue bool
+}
+
+// Apply is a no-op because logging will be reloaded after options are applied.
+func (t *traceOption) Apply(server *Server) {
+	server.Noticef("Reloaded: trace = %v", t.newValue)
+}
+
+// debugOption implements the option interface for the `debug` setting.
+type debugOption struct {
+	loggingOption
+	newValue bool
+}
+
+// Apply is a no-op because logging will be reloaded after options are applied.
+func (d *debugOption) Apply(server *Server) {
+	server.Noticef("Reloaded: debug = %v", d.newValue)
+}
+
+// authOption is a base struct that provides default option behaviors.
+type authOption struct {
+	noopOption
+}
+
+func (o authOption) IsAuthChange() bool {
+	return true
+}
+
+// usernameOption implements the option interface for the `username` setting.
+type usernameOption struct {
+	authOption
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (u *usernameOption) Apply(server *Server) {
+	server.Noticef("Reloaded: authorization username")
+}
+
+// passwordOption implements the option interface for the `password` setting.
+type passwordOption struct {
+	authOption
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (p *passwordOption) Apply(server *Server) {
+	server.Noticef("Reloaded: authorization password")
+}
+
+// authorizationOption implements the option interface for the `token`
+// authorization setting.
+type authorizationOption struct {
+	authOption
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (a *authorizationOption) Apply(server *Server) {
+	server.Noticef("Reloaded: authorization token")
+}
+
+// usersOption implements the option interface for the authorization `users`
+// setting, including their permissions.
+type usersOption struct {
+	authOption
+	newValue []*User
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (u *usersOption) Apply(server *Server) {
+	server.Noticef("Reloaded: authorization users")
+}
+
+// tlsOption implements the option interface for the `tls` setting.
+type tlsOption struct {
+	noopOption
+	newValue *tls.Config
+}
+
+// Apply the tls change. New clients get the new certificates, the
+// connected ones are left alone.
+func (t *tlsOption) Apply(server *Server) {
+	server.mu.Lock()
+	tlsRequired := t.newValue != nil
+	server.info.TLSRequired = tlsRequired
+	server.info.SSLRequired = tlsRequired
+	message := "disabled"
+	if tlsRequired {
+		server.info.TLSVerify = (t.newValue.ClientAuth == tls.RequireAndVerifyClientCert)
+		message = "enabled"
+	} else {
+		server.info.TLSVerify = false
+	}
+	server.generateServerInfoJSON()
+	server.mu.Unlock()
+	server.Noticef("Reloaded: tls = %s", message)
+}
+
+// maxConnOption implements the option interface for the `max_connections`
+// setting.
+type maxConnOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply the max_connections change by closing random connections till we
+// are below the limit if necessary.
+func (m *maxConnOption) Apply(server *Server) {
+	server.mu.Lock()
+	var clients []*client
+	if m.newValue > 0 && len(server.clients) > m.newValue {
+		// 随机挑选需要关闭的连接
+		clients = make([]*client, 0, len(server.clients)-m.newValue)
+		for _, c := range server.clients {
+			clients = append(clients, c)
+			if len(server.clients)-len(clients) <= m.newValue {
+				break
+			}
+		}
+	}
+	server.mu.Unlock()
+	if len(clients) > 0 {
+		server.Noticef("Closing %d clients due to max connections reload", len(clients))
+		for _, c := range clients {
+			c.maxConnExceeded()
+		}
+	}
+	server.Noticef("Reloaded: max_connections = %v", m.newValue)
+}
+
+// maxPayloadOption implements the option interface for the `max_payload`
+// setting.
+type maxPayloadOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply the new max payload to the server INFO and to every client.
+func (m *maxPayloadOption) Apply(server *Server) {
+	server.mu.Lock()
+	server.info.MaxPayload = m.newValue
+	server.generateServerInfoJSON()
+	for _, c := range server.clients {
+		atomic.StoreInt64(&c.mpay, int64(m.newValue))
+	}
+	server.mu.Unlock()
+	server.sendAsyncInfoToClients()
+	server.Noticef("Reloaded: max_payload = %d", m.newValue)
+}
+
+// pingIntervalOption implements the option interface for the `ping_interval`
+// setting.
+type pingIntervalOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op because the ping timer picks up the new value
+// the next time it is armed.
+func (p *pingIntervalOption) Apply(server *Server) {
+	server.Noticef("Reloaded: ping_interval = %s", p.newValue)
+}
+
+// maxPingsOutOption implements the option interface for the `ping_max`
+// setting.
+type maxPingsOutOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply is a no-op because the value is read on every ping.
+func (m *maxPingsOutOption) Apply(server *Server) {
+	server.Noticef("Reloaded: ping_max = %d", m.newValue)
+}
+
+// writeDeadlineOption implements the option interface for the
+// `write_deadline` setting.
+type writeDeadlineOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op because the value is read on every flush.
+func (w *writeDeadlineOption) Apply(server *Server) {
+	server.Noticef("Reloaded: write_deadline = %s", w.newValue)
+}
+
+// maxPendingOption implements the option interface for the `max_pending`
+// setting.
+type maxPendingOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply is a no-op because the value is read on every delivered message.
+func (m *maxPendingOption) Apply(server *Server) {
+	server.Noticef("Reloaded: max_pending = %d", m.newValue)
+}
+
+// routesOption implements the option interface for the cluster `routes`
+// setting.
+type routesOption struct {
+	noopOption
+	add    []*url.URL
+	remove []*url.URL
+}
+
+// Apply the route changes by adding and removing the necessary routes.
+func (r *routesOption) Apply(server *Server) {
+	server.mu.Lock()
+	routes := make([]*client, 0, len(server.routes))
+	for _, route := range server.routes {
+		routes = append(routes, route)
+	}
+	server.mu.Unlock()
+
+	// Remove routes.
+	for _, remove := range r.remove {
+		for _, c := range routes {
+			c.mu.Lock()
+			match := c.route != nil && c.route.url != nil && urlsAreEqual(c.route.url, remove)
+			c.mu.Unlock()
+			if match {
+				c.setRouteNoReconnectOnClose()
+				c.closeConnection()
+				server.Noticef("Removed route %v", remove)
+			}
+		}
+	}
+
+	// Add routes.
+	server.solicitRoutes(r.add)
+
+	server.Noticef("Reloaded: cluster routes")
+}
+
+// Reload reads the current configuration file and applies any supported
+// changes to the running server. Options given on the command line keep
+// precedence over the ones in the file.
+func (s *Server) Reload() error {
+	s.mu.Lock()
+	configFile := s.configFile
+	s.mu.Unlock()
+
+	if configFile == _EMPTY_ {
+		return errors.New("Can only reload config when a file is provided using -c or --config")
+	}
+	newOpts, err := ProcessConfigFile(configFile)
+	if err != nil {
+		// TODO: Dump previous good config to a .bak file?
+		return err
+	}
+	// Apply flags over config file settings.
+	newOpts = MergeOptions(newOpts, FlagSnapshot)
+	processOptions(newOpts)
+
+	// The accept loops write the ports picked for RANDOM_PORT back into the
+	// running options, so a random port in the file means the current one.
+	// processOptions has already turned the client one into 0.
+	curOpts := s.getOpts()
+	if newOpts.Port == 0 {
+		newOpts.Port = curOpts.Port
+	}
+	if newOpts.Cluster.Port == RANDOM_PORT {
+		newOpts.Cluster.Port = curOpts.Cluster.Port
+	}
+	return s.reloadOptions(newOpts)
+}
+
+// reloadOptions reloads the server config with the provided options. If an
+// option that doesn't support hot-swapping is changed, this returns an error.
+func (s *Server) reloadOptions(newOpts *Options) error {
+	changed, err := s.diffOptions(newOpts)
+	if err != nil {
+		return err
+	}
+	s.setOpts(newOpts)
+	s.applyOptions(changed)
+	return nil
+}
+
+// diffOptions returns a slice containing options which have been changed. If
+// any option that doesn't support hot-swapping is changed, this returns an
+// error listing all of them.
+func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
+	var (
+		oldConfig   = reflect.ValueOf(s.getOpts()).Elem()
+		newConfig   = reflect.ValueOf(newOpts).Elem()
+		diffOpts    = []option{}
+		unsupported = []string{}
+	)
+
+	for i := 0; i < oldConfig.NumField(); i++ {
+		var (
+			field    = oldConfig.Type().Field(i)
+			oldValue = oldConfig.Field(i).Interface()
+			newValue = newConfig.Field(i).Interface()
+			changed  = !reflect.DeepEqual(oldValue, newValue)
+		)
+		if !changed {
+			continue
+		}
+		switch strings.ToLower(field.Name) {
+		case "configfile":
+			// Not an option of the running server, it is the file itself.
+		case "nosigs":
+			// Only set when embedding the server, never from the file.
+		case "trace":
+			diffOpts = append(diffOpts, &traceOption{newValue: newValue.(bool)})
+		case "debug":
+			diffOpts = append(diffOpts, &debugOption{newValue: newValue.(bool)})
+		case "tls":
+			// Applied together with the tlsconfig.
+		case "tlsconfig":
+			diffOpts = append(diffOpts, &tlsOption{newValue: newValue.(*tls.Config)})
+		case "username":
+			diffOpts = append(diffOpts, &usernameOption{})
+		case "password":
+			diffOpts = append(diffOpts, &passwordOption{})
+		case "authorization":
+			diffOpts = append(diffOpts, &authorizationOption{})
+		case "users":
+			diffOpts = append(diffOpts, &usersOption{newValue: newValue.([]*User)})
+		case "maxconn":
+			diffOpts = append(diffOpts, &maxConnOption{newValue: newValue.(int)})
+		case "maxpayload":
+			diffOpts = append(diffOpts, &maxPayloadOption{newValue: newValue.(int)})
+		case "pinginterval":
+			diffOpts = append(diffOpts, &pingIntervalOption{newValue: newValue.(time.Duration)})
+		case "maxpingsout":
+			diffOpts = append(diffOpts, &maxPingsOutOption{newValue: newValue.(int)})
+		case "writedeadline":
+			diffOpts = append(diffOpts, &writeDeadlineOption{newValue: newValue.(time.Duration)})
+		case "maxpending":
+			diffOpts = append(diffOpts, &maxPendingOption{newValue: newValue.(int)})
+		case "routes":
+			add, remove := diffRoutes(oldValue.([]*url.URL), newValue.([]*url.URL))
+			diffOpts = append(diffOpts, &routesOption{add: add, remove: remove})
+		default:
+			// Keep going so that all unsupported changes are reported at once.
+			unsupported = append(unsupported, fmt.Sprintf("%s: old=%v, new=%v",
+				field.Name, oldValue, newValue))
+		}
+	}
+
+	// Bail out if attempting to reload any unsupported options.
+	if len(unsupported) > 0 {
+		return nil, fmt.Errorf("Config reload not supported for %s",
+			strings.Join(unsupported, "; "))
+	}
+	return diffOpts, nil
+}
+
+func (s *Server) applyOptions(opts []option) {
+	var (
+		reloadLogging = false
+		reloadAuth    = false
+	)
+	for _, opt := range opts {
+		opt.Apply(s)
+		if opt.IsLoggingChange() {
+			reloadLogging = true
+		}
+		if opt.IsAuthChange() {
+			reloadAuth = true
+		}
+	}
+
+	if reloadLogging {
+		s.ConfigureLogger()
+	}
+	if reloadAuth {
+		s.reloadAuthorization()
+	}
+
+	s.Noticef("Reloaded server configuration")
+}
+
+// reloadAuthorization reconfigures the server authorization settings and
+// re-checks every connected client, registering users again so that their
+// permissions are updated, and disconnects the ones no longer authorized.
+func (s *Server) reloadAuthorization() {
+	s.mu.Lock()
+	s.configureAuthorization()
+	s.generateServerInfoJSON()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	hasUsers := s.users != nil
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		// Disconnect any unauthorized clients.
+		if !s.isClientAuthorized(c) {
+			c.authViolation()
+			continue
+		}
+		// Without users there are no permissions, drop any previous ones.
+		if !hasUsers {
+			c.RegisterUser(&User{})
+		}
+	}
+}
+
+// setOpts swaps the options of the running server.
+func (s *Server) setOpts(opts *Options) {
+	s.optsMu.Lock()
+	s.opts = opts
+	s.optsMu.Unlock()
+}
+
+// diffRoutes diffs the old routes and the new routes and returns the ones that
+// should be added and removed from the server.
+func diffRoutes(old, new []*url.URL) (add, remove []*url.URL) {
+	// Find routes to remove.
+removeLoop:
+	for _, oldRoute := range old {
+		for _, newRoute := range new {
+			if urlsAreEqual(oldRoute, newRoute) {
+				continue removeLoop
+			}
+		}
+		remove = append(remove, oldRoute)
+	}
+
+	// Find routes to add.
+addLoop:
+	for _, newRoute := range new {
+		for _, oldRoute := range old {
+			if urlsAreEqual(oldRoute, newRoute) {
+				continue addLoop
+			}
+		}
+		add = append(add, newRoute)
+	}
+
+	return add, remove
+}
+
+func urlsAreEqual(u1, u2 *url.URL) bool {
+	return reflect.DeepEqual(u1, u2)
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReloadOptions(t *testing.T) {
+	s := New(&Options{Port: 4333})
+	s.SetLogger(nil, false, false)
+
+	// Copy the current options and change what can be applied live.
+	newOpts := *s.getOpts()
+	newOpts.MaxPayload = 512
+	newOpts.MaxConn = 10
+	newOpts.Users = []*User{{Username: "derek", Password: "foo"}}
+
+	if err := s.reloadOptions(&newOpts); err != nil {
+		t.Fatalf("Unexpected error on reload: %v", err)
+	}
+	if s.getOpts().MaxPayload != 512 || s.info.MaxPayload != 512 {
+		t.Fatalf("Expected max payload to be reloaded, got %d", s.info.MaxPayload)
+	}
+	if !s.info.AuthRequired || s.users["derek"] == nil {
+		t.Fatal("Expected users to be reloaded")
+	}
+	if !strings.Contains(string(s.infoJSON), `"max_payload":512`) {
+		t.Fatalf("Expected INFO to be regenerated, got %q", s.infoJSON)
+	}
+}
+
+func TestReloadUnsupportedOption(t *testing.T) {
+	s := New(&Options{Port: 4333})
+	s.SetLogger(nil, false, false)
+
+	newOpts := *s.getOpts()
+	newOpts.Port = 4334
+	newOpts.Host = "127.0.0.2"
+	newOpts.MaxPayload = 512
+
+	// Every unsupported change is reported, not just the first one.
+	err := s.reloadOptions(&newOpts)
+	if err == nil || !strings.Contains(err.Error(), "Port") || !strings.Contains(err.Error(), "Host") {
+		t.Fatalf("Expected error for port and host change, got %v", err)
+	}
+	// Nothing should have been applied.
+	if s.getOpts().Port != 4333 || s.getOpts().MaxPayload != MAX_PAYLOAD_SIZE {
+		t.Fatal("Expected options to be left untouched")
+	}
+}
+
+func TestReloadWithoutConfigFile(t *testing.T) {
+	s := New(&Options{})
+	s.SetLogger(nil, false, false)
+	if err := s.Reload(); err == nil {
+		t.Fatal("Expected error reloading without a config file")
+	}
+}
+
+func TestReloadConfigFileRandomPorts(t *testing.T) {
+	conf := `
+host: 127.0.0.1
+port: -1
+max_payload: %d
+cluster {
+  host: 127.0.0.1
+  port: -1
+}
+`
+	fp, cleanup := writeConfigFile(t, fmt.Sprintf(conf, 1024))
+	defer cleanup()
+	opts, err := ProcessConfigFile(fp)
+	if err != nil {
+		t.Fatalf("Unexpected error processing config file: %v", err)
+	}
+	s := runServer(t, opts)
+	defer s.Shutdown()
+
+	// The resolved ports are not a change of the configuration.
+	if err := ioutil.WriteFile(fp, []byte(fmt.Sprintf(conf, 512)), 0600); err != nil {
+		t.Fatalf("Could not write config file: %v", err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Unexpected error on reload: %v", err)
+	}
+	if mp := s.getOpts().MaxPayload; mp != 512 {
+		t.Fatalf("Expected max payload to be reloaded, got %d", mp)
+	}
+	if port := s.getOpts().Port; port != s.Addr().(*net.TCPAddr).Port {
+		t.Fatalf("Expected the listening port to be kept, got %d", port)
+	}
+	if port := s.getOpts().Cluster.Port; port != s.clusterAddr().Port {
+		t.Fatalf("Expected the listening cluster port to be kept, got %d", port)
+	}
+}
+
+func TestReloadConfigFileUnsupported(t *testing.T) {
+	fp, cleanup := writeConfigFile(t, "host: 127.0.0.1\nport: -1\n")
+	defer cleanup()
+	opts, err := ProcessConfigFile(fp)
+	if err != nil {
+		t.Fatalf("Unexpected error processing config file: %v", err)
+	}
+	s := runServer(t, opts)
+	defer s.Shutdown()
+
+	conf := "host: 127.0.0.2\nport: 4334\nmax_payload: 512\n"
+	if err := ioutil.WriteFile(fp, []byte(conf), 0600); err != nil {
+		t.Fatalf("Could not write config file: %v", err)
+	}
+	err = s.Reload()
+	if err == nil || !strings.Contains(err.Error(), "Port") || !strings.Contains(err.Error(), "Host") {
+		t.Fatalf("Expected error for port and host change, got %v", err)
+	}
+	if mp := s.getOpts().MaxPayload; mp != MAX_PAYLOAD_SIZE {
+		t.Fatalf("Expected options to be left untouched, got max payload %d", mp)
+	}
+}
+
+func TestReloadRemovesUsers(t *testing.T) {
+	s := runServer(t, &Options{Users: []*User{
+		{Username: "alice", Password: "foo"},
+		{Username: "bob", Password: "bar"},
+	}})
+	defer s.Shutdown()
+
+	alice := newTestConn(t, s)
+	defer alice.close()
+	alice.connect(`{"verbose":false,"user":"alice","pass":"foo"}`)
+	bob := newTestConn(t, s)
+	defer bob.close()
+	bob.connect(`{"verbose":false,"user":"bob","pass":"bar"}`)
+
+	// Drop bob, he is disconnected and can not come back.
+	newOpts := *s.getOpts()
+	newOpts.Users = []*User{{Username: "alice", Password: "foo"}}
+	if err := s.reloadOptions(&newOpts); err != nil {
+		t.Fatalf("Unexpected error on reload: %v", err)
+	}
+	bob.expect("-ERR 'Authorization Violation'")
+	bob.expectClosed()
+	alice.flush()
+
+	bob = newTestConn(t, s)
+	defer bob.close()
+	bob.send("CONNECT {\"verbose\":false,\"user\":\"bob\",\"pass\":\"bar\"}\r\n")
+	bob.expect("-ERR 'Authorization Violation'")
+
+	// Switching to a token must drop the users altogether. The server
+	// keeps the options it was given, so reload from a fresh copy.
+	tokenOpts := *s.getOpts()
+	tokenOpts.Users = nil
+	tokenOpts.Authorization = "secret"
+	if err := s.reloadOptions(&tokenOpts); err != nil {
+		t.Fatalf("Unexpected error on reload: %v", err)
+	}
+	alice.expect("-ERR 'Authorization Violation'")
+	alice.expectClosed()
+
+	alice = newTestConn(t, s)
+	defer alice.close()
+	alice.send("CONNECT {\"verbose\":false,\"user\":\"alice\",\"pass\":\"foo\"}\r\n")
+	alice.expect("-ERR 'Authorization Violation'")
+
+	c := newTestConn(t, s)
+	defer c.close()
+	c.connect(`{"verbose":false,"auth_token":"secret"}`)
+}
+
+func TestReloadUpdatesPermissions(t *testing.T) {
+	s := runServer(t, &Options{Users: []*User{{Username: "alice", Password: "foo",
+		Permissions: &Permissions{Publish: &SubjectPermission{Allow: []string{"foo"}}}}}})
+	defer s.Shutdown()
+
+	c := newTestConn(t, s)
+	defer c.close()
+	c.connect(`{"verbose":false,"user":"alice","pass":"foo"}`)
+	c.send("PUB foo 2\r\nok\r\n")
+	c.flush()
+
+	// The connected client must pick up the new permissions.
+	newOpts := *s.getOpts()
+	newOpts.Users = []*User{{Username: "alice", Password: "foo",
+		Permissions: &Permissions{Publish: &SubjectPermission{Allow: []string{"bar"}}}}}
+	if err := s.reloadOptions(&newOpts); err != nil {
+		t.Fatalf("Unexpected error on reload: %v", err)
+	}
+	c.send("PUB foo 2\r\nok\r\n")
+	c.expect(`-ERR 'Permissions Violation for Publish to "foo"'`)
+	c.send("PUB bar 2\r\nok\r\n")
+	c.flush()
+
+	// Without permissions everything is allowed again.
+	noPermOpts := *s.getOpts()
+	noPermOpts.Users = []*User{{Username: "alice", Password: "foo"}}
+	if err := s.reloadOptions(&noPermOpts); err != nil {
+		t.Fatalf("Unexpected error on reload: %v", err)
+	}
+	c.send("PUB foo 2\r\nok\r\n")
+	c.flush()
+}
@@ -1,7 +1,27 @@
 package server
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RouteType designates the router type
+type RouteType int
+
+// Type of Route
+const (
+	// This route we learned from speaking to other routes.
+	Implicit RouteType = iota
+	// This route was explicitly configured.
+	Explicit
 )
 
 type connectInfo struct {
@@ -17,8 +37,603 @@ const (
 	_EMPTY_ = ""
 )
 
+// Route protocol constants
+const (
+	ConProto  = "CONNECT %s" + CR_LF
+	InfoProto = "INFO %s" + CR_LF
+)
+
 type route struct {
-	remoteID string
+	remoteID     string // 对端Server的ID
+	didSolicit   bool   // 是否是由我们主动发起的连接
+	retry        bool   // 连接断开后是否需要重连
+	routeType    RouteType
+	url          *url.URL
+	authRequired bool
+	tlsRequired  bool
+	closed       bool // 连接关闭时不再重连
+}
+
+// Lock should be held entering here.
+func (c *client) sendConnect(tlsRequired bool) {
+	var user, pass string
+	if userInfo := c.route.url.User; userInfo != nil {
+		user = userInfo.Username()
+		pass, _ = userInfo.Password()
+	}
+	cinfo := connectInfo{
+		Verbose:  false,
+		Pedantic: false,
+		User:     user,
+		Pass:     pass,
+		TLS:      tlsRequired,
+		Name:     c.srv.info.ID,
+	}
+	b, err := json.Marshal(cinfo)
+	if err != nil {
+		c.Errorf("Error marshaling CONNECT to route: %v\n", err)
+		c.closeConnection()
+		return
+	}
+	c.sendProto([]byte(fmt.Sprintf(ConProto, b)), true)
+}
+
+// Process the info message if we are a route.
+func (c *client) processRouteInfo(info *Info) {
+	c.mu.Lock()
+	// Connection can be closed at any time (by auth timeout, etc).
+	// Does not make sense to continue here if connection is gone.
+	if c.route == nil || c.nc == nil {
+		c.mu.Unlock()
+		return
+	}
+
+	s := c.srv
+	remoteID := c.route.remoteID
+
+	// We receive an INFO from a server that informs us about another server,
+	// so the info.ID in the INFO protocol does not match the ID of this route.
+	if remoteID != "" && remoteID != info.ID {
+		c.mu.Unlock()
+
+		// Process this implicit route. We will check that it is not an explicit
+		// route and/or that it has not been connected already.
+		s.processImplicitRoute(info)
+		return
+	}
+
+	// Need to set this for the detection of the route to self to work
+	// in closeConnection().
+	c.route.remoteID = info.ID
+
+	// Detect route to self.
+	if c.route.remoteID == s.info.ID {
+		c.mu.Unlock()
+		c.closeConnection()
+		return
+	}
+
+	// Copy over important information.
+	c.route.authRequired = info.AuthRequired
+	c.route.tlsRequired = info.TLSRequired
+
+	// If we do not know this route's URL, construct one on the fly
+	// from the information provided.
+	if c.route.url == nil {
+		// Add in the URL from host and port
+		hp := net.JoinHostPort(info.Host, strconv.Itoa(info.Port))
+		url, err := url.Parse(fmt.Sprintf("nats-route://%s/", hp))
+		if err != nil {
+			c.Errorf("Error parsing URL from INFO: %v\n", err)
+			c.mu.Unlock()
+			c.closeConnection()
+			return
+		}
+		c.route.url = url
+	}
+	c.mu.Unlock()
+
+	// Check to see if we have this remote already registered.
+	// This can happen when both servers have routes to each other.
+	if added, sendInfo := s.addRoute(c, info); added {
+		c.Debugf("Registering remote route %q", info.ID)
+		// Send our local subscriptions to this route.
+		s.sendLocalSubsToRoute(c)
+		if sendInfo {
+			// Need to get the remote IP address.
+			c.mu.Lock()
+			switch conn := c.nc.(type) {
+			case *net.TCPConn, *tls.Conn:
+				addr := conn.RemoteAddr().(*net.TCPAddr)
+				info.IP = fmt.Sprintf("nats-route://%s/", net.JoinHostPort(addr.IP.String(), strconv.Itoa(info.Port)))
+			default:
+				info.IP = c.route.url.String()
+			}
+			c.mu.Unlock()
+			// Now let the known servers know about this new route
+			s.forwardNewRouteInfoToKnownServers(info)
+		}
+		// If the server Info did not have these URLs, update and send an INFO
+		// protocol to all clients that support it.
+		if s.updateServerINFO(info.ClientConnectURLs) {
+			s.sendAsyncInfoToClients()
+		}
+	} else {
+		c.Debugf("Detected duplicate remote route %q", info.ID)
+		c.closeConnection()
+	}
+}
+
+// This will send local subscription state to a new route connection.
+// FIXME(dlc) - This could be a DOS or perf issue with many clients
+// and large subscription space. Plus buffering in place not a good idea.
+func (s *Server) sendLocalSubsToRoute(route *client) {
+	b := bytes.Buffer{}
+	s.mu.Lock()
+	for _, client := range s.clients {
+		client.mu.Lock()
+		subs := make([]*subscription, 0, len(client.subs))
+		for _, sub := range client.subs {
+			subs = append(subs, sub)
+		}
+		client.mu.Unlock()
+		for _, sub := range subs {
+			rsid := routeSid(sub)
+			proto := fmt.Sprintf(subProto, sub.subject, sub.queue, rsid)
+			b.WriteString(proto)
+		}
+	}
+	s.mu.Unlock()
+
+	route.mu.Lock()
+	defer route.mu.Unlock()
+	route.sendProto(b.Bytes(), true)
+
+	route.Debugf("Route sent local subscriptions")
+}
+
+// This will process implicit route information received from another server.
+// We will check to see if we have configured or are already connected,
+// and if so we will ignore. Otherwise we will attempt to connect.
+func (s *Server) processImplicitRoute(info *Info) {
+	remoteID := info.ID
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Don't connect to ourself
+	if remoteID == s.info.ID {
+		return
+	}
+	// Check if this route already exists
+	if _, exists := s.remotes[remoteID]; exists {
+		return
+	}
+	// Check if we have this route as a configured route
+	if s.hasThisRouteConfigured(info) {
+		return
+	}
+
+	// Initiate the connection, using info.IP instead of info.URL here...
+	r, err := url.Parse(info.IP)
+	if err != nil {
+		s.Errorf("Error parsing URL from INFO: %v\n", err)
+		return
+	}
+
+	// Snapshot server options.
+	opts := s.getOpts()
+
+	if info.AuthRequired {
+		r.User = url.UserPassword(opts.Cluster.Username, opts.Cluster.Password)
+	}
+	s.startGoRoutine(func() { s.connectToRoute(r, false) })
+}
+
+// hasThisRouteConfigured returns true if info.Host:info.Port is present
+// in the server's opts.Routes, false otherwise.
+// Server lock is assumed to be held by caller.
+func (s *Server) hasThisRouteConfigured(info *Info) bool {
+	urlToCheckExplicit := strings.ToLower(net.JoinHostPort(info.Host, strconv.Itoa(info.Port)))
+	for _, ri := range s.getOpts().Routes {
+		if strings.ToLower(ri.Host) == urlToCheckExplicit {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardNewRouteInfoToKnownServers sends the INFO protocol of the new route
+// to all routes known by this server. In turn, each server will contact this
+// new route.
+func (s *Server) forwardNewRouteInfoToKnownServers(info *Info) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, _ := json.Marshal(info)
+	infoJSON := []byte(fmt.Sprintf(InfoProto, b))
+
+	for _, r := range s.routes {
+		r.mu.Lock()
+		if r.route.remoteID != info.ID {
+			r.sendInfo(infoJSON)
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
+	// Snapshot server options.
+	opts := s.getOpts()
+
+	didSolicit := rURL != nil
+	r := &route{didSolicit: didSolicit}
+	for _, route := range opts.Routes {
+		if rURL != nil && (strings.ToLower(rURL.Host) == strings.ToLower(route.Host)) {
+			r.routeType = Explicit
+		}
+	}
+
+	c := &client{srv: s, nc: conn, opts: clientOpts{}, typ: ROUTER, route: r}
+
+	// Grab server variables
+	s.mu.Lock()
+	infoJSON := s.routeInfoJSON
+	authRequired := s.routeInfo.AuthRequired
+	s.mu.Unlock()
+
+	// Grab lock
+	c.mu.Lock()
+
+	// Initialize
+	c.initClient()
+
+	if didSolicit {
+		r.url = rURL
+	}
+
+	// Do final client initialization
+
+	// Set the Ping timer
+	c.setPingTimer()
+
+	// For routes, the "client" is added to s.routes only when processing
+	// the INFO protocol, that is much later.
+	// In the meantime, if the server shutsdown, there would be no reference
+	// to the client (connection) to be closed, leaving this readLoop
+	// uinterrupted, causing the Shutdown() to wait indefinitively.
+	// We need to store the client in a special map, under a special lock.
+	s.grMu.Lock()
+	running := s.grRunning
+	if running {
+		s.grTmpClients[c.cid] = c
+	}
+	s.grMu.Unlock()
+	if !running {
+		c.mu.Unlock()
+		c.setRouteNoReconnectOnClose()
+		c.closeConnection()
+		return nil
+	}
+
+	// Spin up the read loop.
+	s.startGoRoutine(func() { c.readLoop() })
+
+	// Queue Connect proto if we solicited the connection.
+	if didSolicit {
+		c.Debugf("Route connect msg sent")
+		c.sendConnect(false)
+	}
+
+	// Send our info to the other side.
+	c.sendInfo(infoJSON)
+
+	// Check for Auth required state for incoming connections.
+	if authRequired && !didSolicit {
+		ttl := AUTH_TIMEOUT
+		if opts.Cluster.AuthTimeout > 0 {
+			ttl = secondsToDuration(opts.Cluster.AuthTimeout)
+		}
+		c.setAuthTimer(ttl)
+	}
+
+	c.mu.Unlock()
+
+	c.Noticef("Route connection created")
+	return c
+}
+
+const (
+	subProto   = "SUB %s %s %s" + CR_LF
+	unsubProto = "UNSUB %s%s" + CR_LF
+)
+
+// Route constants
+// 路由之间转发的订阅，sid会被改写成 RSID:cid:sid 的形式，
+// 这样对端回传消息时我们可以找到对应的本地订阅。
+const (
+	RSID  = "RSID"
+	QRSID = "QRSID"
+
+	RSID_CID_INDEX   = 1
+	RSID_SID_INDEX   = 2
+	EXPECTED_MATCHES = 3
+)
+
+// Parse the given rsid. If the protocol does not start with QRSID,
+// returns false and no subscription nor error.
+// If it does start with QRSID, returns true and possibly a subscription
+// or an error if the QRSID protocol is malformed.
+func (s *Server) routeSidQueueSubscriber(rsid []byte) (bool, *subscription, error) {
+	if !bytes.HasPrefix(rsid, []byte(QRSID)) {
+		return false, nil, nil
+	}
+	cid, sid, ok := parseRouteSid(rsid)
+	if !ok {
+		return true, nil, fmt.Errorf("invalid route queue sid: %q", rsid)
+	}
+
+	s.mu.Lock()
+	client := s.clients[cid]
+	s.mu.Unlock()
+
+	if client == nil {
+		return true, nil, nil
+	}
+
+	client.mu.Lock()
+	sub, ok := client.subs[string(sid)]
+	client.mu.Unlock()
+	if ok {
+		return true, sub, nil
+	}
+	return true, nil, nil
+}
+
+// routeSid builds the sid used for a local subscription when it is
+// forwarded to other servers.
+func routeSid(sub *subscription) string {
+	var qi string
+	if len(sub.queue) > 0 {
+		qi = "Q"
+	}
+	return fmt.Sprintf("%s%s:%d:%s", qi, RSID, sub.client.cid, sub.sid)
+}
+
+// parseRouteSid extracts the client id and the original sid
+// from a [Q]RSID:cid:sid route sid.
+func parseRouteSid(rsid []byte) (uint64, []byte, bool) {
+	parts := bytes.SplitN(rsid, []byte(":"), EXPECTED_MATCHES)
+	if len(parts) != EXPECTED_MATCHES {
+		return 0, nil, false
+	}
+	if !bytes.Equal(parts[0], []byte(RSID)) && !bytes.Equal(parts[0], []byte(QRSID)) {
+		return 0, nil, false
+	}
+	cid := parseSize(parts[RSID_CID_INDEX])
+	if cid < 0 || len(parts[RSID_SID_INDEX]) == 0 {
+		return 0, nil, false
+	}
+	return uint64(cid), parts[RSID_SID_INDEX], true
+}
+
+// checkRouteDelivery reports whether a message processed by c should be sent
+// to the route owning sub. A message that came in over a route is never sent
+// to another route (1-hop semantics), and each remote server only receives
+// the message once no matter how many of its subscriptions matched. rmap
+// tracks the remote servers already sent to for the current message.
+func (c *client) checkRouteDelivery(sub *subscription, rmap map[string]struct{}) bool {
+	// Skip if sourced from a ROUTER and going to another ROUTER.
+	if c.typ == ROUTER {
+		return false
+	}
+	sub.client.mu.Lock()
+	defer sub.client.mu.Unlock()
+	if sub.client.nc == nil || sub.client.route == nil ||
+		sub.client.route.remoteID == "" {
+		c.Debugf("Bad or Missing ROUTER Identity, not processing msg")
+		return false
+	}
+	if _, ok := rmap[sub.client.route.remoteID]; ok {
+		c.Debugf("Ignoring route, already processed and sent msg")
+		return false
+	}
+	rmap[sub.client.route.remoteID] = routeSeen
+	return true
+}
+
+// addRoute registers the route once its INFO has been processed. It returns
+// false if we already have a route to this remote server, and whether the
+// other routes need to be told about this new one.
+func (s *Server) addRoute(c *client, info *Info) (bool, bool) {
+	id := c.route.remoteID
+	sendInfo := false
+
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return false, false
+	}
+	remote, exists := s.remotes[id]
+	if !exists {
+		// Remove from the temporary map
+		s.grMu.Lock()
+		delete(s.grTmpClients, c.cid)
+		s.grMu.Unlock()
+
+		s.routes[c.cid] = c
+		s.remotes[id] = c
+
+		// we don't need to send if the only route is the one we just accepted.
+		sendInfo = len(s.routes) > 1
+	}
+	s.mu.Unlock()
+
+	if exists {
+		var r *route
+
+		c.mu.Lock()
+		// upgrade to solicited?
+		if c.route.didSolicit {
+			// Make a copy
+			rs := *c.route
+			r = &rs
+		}
+		c.mu.Unlock()
+
+		remote.mu.Lock()
+		// r will be not nil if c.route.didSolicit was true
+		if r != nil {
+			remote.route = r
+		}
+		// This is to mitigate the issue where both sides add the route
+		// on the opposite connection, and therefore end-up with both
+		// connections being dropped.
+		remote.route.retry = true
+		remote.mu.Unlock()
+	}
+
+	return !exists, sendInfo
+}
+
+func (s *Server) broadcastInterestToRoutes(proto string) {
+	var arg []byte
+	if atomic.LoadInt32(&s.logging.trace) == 1 {
+		arg = []byte(proto[:len(proto)-LEN_CR_LF])
+	}
+	protoAsBytes := []byte(proto)
+	s.mu.Lock()
+	for _, route := range s.routes {
+		route.mu.Lock()
+		route.sendProto(protoAsBytes, true)
+		route.mu.Unlock()
+		route.traceOutOp("", arg)
+	}
+	s.mu.Unlock()
+}
+
+// broadcastSubscribe will forward a client subscription
+// to all active routes.
+func (s *Server) broadcastSubscribe(sub *subscription) {
+	if s.numRoutes() == 0 {
+		return
+	}
+	rsid := routeSid(sub)
+	proto := fmt.Sprintf(subProto, sub.subject, sub.queue, rsid)
+	s.broadcastInterestToRoutes(proto)
+}
+
+// broadcastUnSubscribe will forward a client unsubscribe
+// action to all active routes.
+func (s *Server) broadcastUnSubscribe(sub *subscription) {
+	if s.numRoutes() == 0 {
+		return
+	}
+	rsid := routeSid(sub)
+	maxStr := _EMPTY_
+	sub.client.mu.Lock()
+	// Set max if we have it set and have not tripped auto-unsubscribe
+	if sub.max > 0 && sub.nm < sub.max {
+		maxStr = fmt.Sprintf(" %d", sub.max)
+	}
+	sub.client.mu.Unlock()
+	proto := fmt.Sprintf(unsubProto, rsid, maxStr)
+	s.broadcastInterestToRoutes(proto)
+}
+
+func (s *Server) routeAcceptLoop(ch chan struct{}) {
+	defer func() {
+		if ch != nil {
+			close(ch)
+		}
+	}()
+
+	// Snapshot server options.
+	opts := s.getOpts()
+
+	port := opts.Cluster.Port
+	if port == RANDOM_PORT {
+		port = 0
+	}
+
+	hp := net.JoinHostPort(opts.Cluster.Host, strconv.Itoa(port))
+	s.Noticef("Listening for route connections on %s", hp)
+	l, e := net.Listen("tcp", hp)
+	if e != nil {
+		s.Fatalf("Error listening on router port: %d - %v", opts.Cluster.Port, e)
+		return
+	}
+
+	// If we have selected a random port...
+	if port == 0 {
+		// Write resolved port back to options.
+		opts.Cluster.Port = l.Addr().(*net.TCPAddr).Port
+	}
+
+	// The client listener is ready at this point, so its port is resolved.
+	var clientURLs []string
+	if !opts.Cluster.NoAdvertise {
+		clientURLs = s.getClientConnectURLs()
+	}
+
+	s.mu.Lock()
+	info := Info{
+		ID:           s.info.ID,
+		Version:      s.info.Version,
+		Host:         opts.Cluster.Host,
+		Port:         opts.Cluster.Port,
+		AuthRequired: false,
+		MaxPayload:   s.info.MaxPayload,
+	}
+	// Set this if only if advertise is not disabled
+	info.ClientConnectURLs = clientURLs
+	// Check for Auth items
+	if opts.Cluster.Username != "" {
+		info.AuthRequired = true
+	}
+	s.routeInfo = info
+	s.generateRouteInfoJSON()
+	// Setup state that can enable shutdown
+	s.routeListener = l
+	s.mu.Unlock()
+
+	// Let them know we are up
+	close(ch)
+	ch = nil
+
+	tmpDelay := ACCEPT_MIN_SLEEP
+
+	for s.isRunning() {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				s.Debugf("Temporary Route Accept Errorf(%v), sleeping %dms",
+					ne, tmpDelay/time.Millisecond)
+				time.Sleep(tmpDelay)
+				tmpDelay *= 2
+				if tmpDelay > ACCEPT_MAX_SLEEP {
+					tmpDelay = ACCEPT_MAX_SLEEP
+				}
+			} else if s.isRunning() {
+				s.Noticef("Accept error: %v", err)
+			}
+			continue
+		}
+		tmpDelay = ACCEPT_MIN_SLEEP
+		s.startGoRoutine(func() {
+			s.createRoute(conn, nil)
+			s.grWG.Done()
+		})
+	}
+	s.Debugf("Router accept loop exiting..")
+	s.done <- true
+}
+
+// generateRouteInfoJSON caches the INFO protocol sent to routes.
+// Lock should be held.
+func (s *Server) generateRouteInfoJSON() {
+	b, _ := json.Marshal(s.routeInfo)
+	s.routeInfoJSON = []byte(fmt.Sprintf(InfoProto, b))
 }
 
 // StartRouting will start the accept loop om the cluster host:port
@@ -39,10 +654,89 @@ func (s *Server) StartRouting(clientListenReady chan struct{}) {
 	s.solicitRoutes(s.getOpts().Routes)
 }
 
-func (s *Server) routeAcceptLoop(ch chan struct{}) {
+// reConnectToRoute is called when a solicited route is lost. Explicit
+// routes are retried forever after DEFAULT_ROUTE_RECONNECT.
+func (s *Server) reConnectToRoute(rURL *url.URL, rtype RouteType) {
+	tryForEver := rtype == Explicit
+	if tryForEver {
+		time.Sleep(DEFAULT_ROUTE_RECONNECT)
+	}
+	s.connectToRoute(rURL, tryForEver)
+}
+
+// connectToRoute dials the route until it succeeds. Implicit routes are only
+// retried Cluster.ConnectRetries times.
+func (s *Server) connectToRoute(rURL *url.URL, tryForEver bool) {
+	// Snapshot server options.
+	opts := s.getOpts()
+
+	defer s.grWG.Done()
 
+	attempts := 0
+	for s.isRunning() && rURL != nil {
+		// The route may have been removed by a config reload.
+		if tryForEver && !s.isRouteConfigured(rURL) {
+			s.Debugf("Route %s is no longer configured, giving up", rURL.Host)
+			return
+		}
+		s.Debugf("Trying to connect to route on %s", rURL.Host)
+		conn, err := net.DialTimeout("tcp", rURL.Host, DEFAULT_ROUTE_DIAL)
+		if err != nil {
+			s.Errorf("Error trying to connect to route: %v", err)
+			if !tryForEver {
+				if opts.Cluster.ConnectRetries <= 0 {
+					return
+				}
+				attempts++
+				if attempts > opts.Cluster.ConnectRetries {
+					return
+				}
+			}
+			select {
+			case <-s.rcQuit:
+				return
+			case <-time.After(DEFAULT_ROUTE_CONNECT):
+				continue
+			}
+		}
+		// We have a route connection here.
+		// Go ahead and create it and exit this func.
+		s.createRoute(conn, rURL)
+		return
+	}
+}
+
+// isRouteConfigured reports whether rURL is one of the explicit routes.
+func (s *Server) isRouteConfigured(rURL *url.URL) bool {
+	for _, r := range s.getOpts().Routes {
+		if urlsAreEqual(r, rURL) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *client) isSolicitedRoute() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.typ == ROUTER && c.route != nil && c.route.didSolicit
+}
+
+func (c *client) setRouteNoReconnectOnClose() {
+	c.mu.Lock()
+	c.route.closed = true
+	c.mu.Unlock()
 }
 
 func (s *Server) solicitRoutes(routes []*url.URL) {
+	for _, r := range routes {
+		route := r
+		s.startGoRoutine(func() { s.connectToRoute(route, true) })
+	}
+}
 
+func (s *Server) numRoutes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.routes)
 }
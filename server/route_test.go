@@ -0,0 +1,354 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func routeURL(t *testing.T, s *Server, userInfo string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(fmt.Sprintf("nats-route://%s%s", userInfo, s.clusterAddr()))
+	if err != nil {
+		t.Fatalf("Could not parse route URL: %v", err)
+	}
+	return u
+}
+
+func runClusterServer(t *testing.T, cluster ClusterOpts, routes ...*url.URL) *Server {
+	t.Helper()
+	cluster.Host = "127.0.0.1"
+	cluster.Port = RANDOM_PORT
+	return runServer(t, &Options{Cluster: cluster, Routes: routes})
+}
+
+// checkClusterFormed waits until every server has a route to all others.
+func checkClusterFormed(t *testing.T, servers ...*Server) {
+	t.Helper()
+	checkFor(t, 5*time.Second, func() error {
+		for _, s := range servers {
+			if n := s.numRoutes(); n != len(servers)-1 {
+				return fmt.Errorf("Expected %d routes on %s, got %d", len(servers)-1, s.info.ID, n)
+			}
+		}
+		return nil
+	})
+}
+
+// remoteRoute returns the route to the server with the given id.
+func (s *Server) remoteRoute(id string) *route {
+	s.mu.Lock()
+	c := s.remotes[id]
+	s.mu.Unlock()
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := *c.route
+	return &r
+}
+
+func TestRouteHandshake(t *testing.T) {
+	srvA := runClusterServer(t, ClusterOpts{})
+	defer srvA.Shutdown()
+	srvB := runClusterServer(t, ClusterOpts{}, routeURL(t, srvA, ""))
+	defer srvB.Shutdown()
+
+	checkClusterFormed(t, srvA, srvB)
+
+	// A accepted the route, B solicited it from its configuration.
+	ra := srvA.remoteRoute(srvB.info.ID)
+	if ra == nil || ra.didSolicit || ra.url == nil {
+		t.Fatalf("Unexpected route on A: %+v", ra)
+	}
+	rb := srvB.remoteRoute(srvA.info.ID)
+	if rb == nil || !rb.didSolicit || rb.routeType != Explicit {
+		t.Fatalf("Unexpected route on B: %+v", rb)
+	}
+}
+
+func TestRouteHandshakeAuthorization(t *testing.T) {
+	cluster := ClusterOpts{Username: "ruser", Password: "top_secret", AuthTimeout: 1}
+	srvA := runClusterServer(t, cluster)
+	defer srvA.Shutdown()
+
+	// Wrong credentials are refused.
+	srvBad := runClusterServer(t, cluster, routeURL(t, srvA, "ruser:wrong@"))
+	defer srvBad.Shutdown()
+	time.Sleep(250 * time.Millisecond)
+	if n := srvA.numRoutes(); n != 0 {
+		t.Fatalf("Expected no routes with bad credentials, got %d", n)
+	}
+	srvBad.Shutdown()
+
+	srvB := runClusterServer(t, cluster, routeURL(t, srvA, "ruser:top_secret@"))
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+}
+
+// checkSubInterest waits until s has n subscriptions on subject.
+func checkSubInterest(t *testing.T, s *Server, subject string, n int) {
+	t.Helper()
+	checkFor(t, 2*time.Second, func() error {
+		r := s.sl.Match(subject)
+		got := len(r.psubs)
+		for _, qsubs := range r.qsubs {
+			got += len(qsubs)
+		}
+		if got != n {
+			return fmt.Errorf("Expected %d subscriptions on %q, got %d", n, subject, got)
+		}
+		return nil
+	})
+}
+
+func TestRouteInterestPropagation(t *testing.T) {
+	srvA := runClusterServer(t, ClusterOpts{})
+	defer srvA.Shutdown()
+	srvB := runClusterServer(t, ClusterOpts{}, routeURL(t, srvA, ""))
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+
+	subB := newTestConn(t, srvB)
+	defer subB.close()
+	subB.connect(`{"verbose":false}`)
+	subB.send("SUB foo 1\r\n")
+	subB.flush()
+
+	// The subscription shows up on A as owned by the route, with the sid
+	// rewritten so B can find its local subscription again.
+	checkSubInterest(t, srvA, "foo", 1)
+	rsub := srvA.sl.Match("foo").psubs[0]
+	if rsub.client.typ != ROUTER {
+		t.Fatal("Expected the remote subscription to belong to the route")
+	}
+	if _, sid, ok := parseRouteSid(rsub.sid); !ok || string(sid) != "1" {
+		t.Fatalf("Unexpected route sid %q", rsub.sid)
+	}
+
+	// A local subscriber on A as well, each gets the message exactly once.
+	subA := newTestConn(t, srvA)
+	defer subA.close()
+	subA.connect(`{"verbose":false}`)
+	subA.send("SUB foo 2\r\n")
+	subA.flush()
+	checkSubInterest(t, srvB, "foo", 2)
+
+	pubA := newTestConn(t, srvA)
+	defer pubA.close()
+	pubA.connect(`{"verbose":false}`)
+	pubA.send("PUB foo 2\r\nok\r\n")
+	pubA.flush()
+
+	subA.expectMsg("foo", "2", "ok")
+	subB.expectMsg("foo", "1", "ok")
+	// Nothing was echoed back over the route.
+	subA.flush()
+	subB.flush()
+
+	// No interest, no forwarding.
+	pubA.send("PUB bar 2\r\nok\r\nPUB foo 3\r\nend\r\n")
+	subB.expectMsg("foo", "1", "end")
+
+	// UNSUB removes the interest on A.
+	subB.send("UNSUB 1\r\n")
+	subB.flush()
+	checkSubInterest(t, srvA, "foo", 1)
+
+	// So does closing the connection.
+	subA.close()
+	checkSubInterest(t, srvB, "foo", 0)
+}
+
+func TestRouteQueueSubscribers(t *testing.T) {
+	srvA := runClusterServer(t, ClusterOpts{})
+	defer srvA.Shutdown()
+	srvB := runClusterServer(t, ClusterOpts{}, routeURL(t, srvA, ""))
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+
+	// Two members of the same group on B, one on A.
+	qsubB := newTestConn(t, srvB)
+	defer qsubB.close()
+	qsubB.connect(`{"verbose":false}`)
+	qsubB.send("SUB foo workers 1\r\nSUB foo workers 2\r\n")
+	qsubB.flush()
+	qsubA := newTestConn(t, srvA)
+	defer qsubA.close()
+	qsubA.connect(`{"verbose":false}`)
+	qsubA.send("SUB foo workers 1\r\n")
+	qsubA.flush()
+	checkSubInterest(t, srvA, "foo", 3)
+
+	for _, sub := range srvA.sl.Match("foo").qsubs[0] {
+		if sub.client.typ == ROUTER && !bytes.HasPrefix(sub.sid, []byte(QRSID)) {
+			t.Fatalf("Expected a queue route sid, got %q", sub.sid)
+		}
+	}
+
+	const total = 50
+	pubA := newTestConn(t, srvA)
+	defer pubA.close()
+	pubA.connect(`{"verbose":false}`)
+	for i := 0; i < total; i++ {
+		pubA.send("PUB foo 2\r\nok\r\n")
+	}
+	pubA.flush()
+
+	// Every message is delivered to a single member of the group.
+	count := func(c *testConn) int {
+		c.send("PING\r\n")
+		n := 0
+		for line := c.readLine(); line != "PONG"; line = c.readLine() {
+			if strings.HasPrefix(line, "MSG ") {
+				n++
+			}
+		}
+		return n
+	}
+	var got int
+	checkFor(t, 2*time.Second, func() error {
+		got += count(qsubA) + count(qsubB)
+		if got != total {
+			return fmt.Errorf("Expected %d queue messages, got %d", total, got)
+		}
+		return nil
+	})
+}
+
+func TestRouteImplicitDiscovery(t *testing.T) {
+	srvA := runClusterServer(t, ClusterOpts{})
+	defer srvA.Shutdown()
+
+	// A client on the seed that understands async INFO.
+	c := newTestConn(t, srvA)
+	defer c.close()
+	c.connect(fmt.Sprintf(`{"verbose":false,"protocol":%d}`, ClientProtoInfo))
+
+	// B and C only know about A, they learn about each other through A.
+	srvB := runClusterServer(t, ClusterOpts{}, routeURL(t, srvA, ""))
+	defer srvB.Shutdown()
+	srvC := runClusterServer(t, ClusterOpts{}, routeURL(t, srvA, ""))
+	defer srvC.Shutdown()
+	checkClusterFormed(t, srvA, srvB, srvC)
+
+	// The gossiped route is implicit on the side that solicited it.
+	if rb, rc := srvB.remoteRoute(srvC.info.ID), srvC.remoteRoute(srvB.info.ID); rb == nil || rc == nil ||
+		(rb.didSolicit && rb.routeType != Implicit) || (rc.didSolicit && rc.routeType != Implicit) {
+		t.Fatalf("Unexpected routes between B and C: %+v, %+v", rb, rc)
+	}
+
+	// No duplicates once the cluster has settled.
+	time.Sleep(100 * time.Millisecond)
+	checkClusterFormed(t, srvA, srvB, srvC)
+	for _, s := range []*Server{srvA, srvB, srvC} {
+		s.mu.Lock()
+		remotes := len(s.remotes)
+		s.mu.Unlock()
+		if remotes != 2 {
+			t.Fatalf("Expected 2 remotes, got %d", remotes)
+		}
+	}
+
+	// The client URLs of the other servers are advertised to A's client.
+	want := map[string]bool{srvB.Addr().String(): true, srvC.Addr().String(): true}
+	checkFor(t, 2*time.Second, func() error {
+		var info Info
+		line := c.expect("INFO ")
+		if err := json.Unmarshal([]byte(line[5:]), &info); err != nil {
+			return err
+		}
+		found := 0
+		for _, u := range info.ClientConnectURLs {
+			if want[u] {
+				found++
+			}
+		}
+		if found != len(want) {
+			return fmt.Errorf("Expected connect urls %v, got %v", want, info.ClientConnectURLs)
+		}
+		return nil
+	})
+}
+
+func TestRouteNoAdvertise(t *testing.T) {
+	srvA := runClusterServer(t, ClusterOpts{NoAdvertise: true})
+	defer srvA.Shutdown()
+	srvB := runClusterServer(t, ClusterOpts{NoAdvertise: true}, routeURL(t, srvA, ""))
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+
+	srvA.mu.Lock()
+	urls := srvA.info.ClientConnectURLs
+	srvA.mu.Unlock()
+	if len(urls) != 0 {
+		t.Fatalf("Expected no advertised client URLs, got %v", urls)
+	}
+}
+
+func TestRouteImplicitConnectRetries(t *testing.T) {
+	s := runClusterServer(t, ClusterOpts{ConnectRetries: 1})
+	defer s.Shutdown()
+
+	// Nothing listens there, an implicit route gives up after
+	// ConnectRetries instead of retrying forever.
+	u, _ := url.Parse("nats-route://127.0.0.1:1/")
+	done := make(chan struct{})
+	s.grWG.Add(1)
+	go func() {
+		s.connectToRoute(u, false)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * DEFAULT_ROUTE_CONNECT):
+		t.Fatal("Expected the implicit route to give up after ConnectRetries")
+	}
+}
+
+func TestRouteAutoUnsubscribe(t *testing.T) {
+	srvA := runClusterServer(t, ClusterOpts{})
+	defer srvA.Shutdown()
+	srvB := runClusterServer(t, ClusterOpts{}, routeURL(t, srvA, ""))
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+
+	sub := newTestConn(t, srvB)
+	defer sub.close()
+	sub.connect(`{"verbose":false}`)
+	sub.send("SUB foo 1\r\nUNSUB 1 3\r\nSUB done 2\r\n")
+	sub.flush()
+	checkSubInterest(t, srvA, "foo", 1)
+	checkSubInterest(t, srvA, "done", 1)
+
+	// The route keeps ordering, so "done" arrives after every "foo".
+	pub := newTestConn(t, srvA)
+	defer pub.close()
+	pub.connect(`{"verbose":false}`)
+	for i := 0; i < 5; i++ {
+		pub.send("PUB foo 2\r\nok\r\n")
+	}
+	pub.send("PUB done 2\r\nok\r\n")
+	pub.flush()
+
+	got := 0
+	for {
+		args := strings.Fields(sub.expect("MSG "))
+		sub.readLine()
+		if args[1] == "done" {
+			break
+		}
+		got++
+	}
+	if got != 3 {
+		t.Fatalf("Expected exactly 3 messages, got %d", got)
+	}
+
+	checkSubInterest(t, srvB, "foo", 0)
+	checkSubInterest(t, srvA, "foo", 0)
+}
@@ -1,10 +1,17 @@
 package server
 
 import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net"
+	"net/http"
+	"net/http/pprof"
 	"os"
+	"runtime"
 	"strconv"
 	"sync"
 	"time"
@@ -20,12 +27,14 @@ type Info struct {
 	SSLRequired       bool     `json:"ssl_required"`  // 是否需要SSL
 	TLSRequired       bool     `json:"tls_required"`  // 是否需要TLS
 	TLSVerify         bool     `json:"tls_verify"`    // TLS需要的证书
-	MaxPayload        int      `int:"max_payload"`    // 最大接受长度
+	MaxPayload        int      `json:"max_payload"`   // 最大接受长度
+	LameDuckMode      bool     `json:"ldm,omitempty"` // 服务器即将下线，客户端应连接其他服务器
 	IP                string   `json:"ip,omitempty"`
 	ClientConnectURLs []string `json:"connect_urls,omitempty"` // 一个URL列表，表示客户端可以连接的服务器地址
 }
 
 type Server struct {
+	gcid uint64 // 全局的client ID生成器
 	stats
 	mu sync.Mutex // Server的全局互斥锁
 
@@ -41,24 +50,40 @@ type Server struct {
 	// Server的状态
 	running  bool
 	shutdown bool
+	ldm      bool // lame duck mode
 	listener net.Listener
+	profiler net.Listener // pprof的监听器
+	http     net.Listener // 监控HTTP(S)的监听器
+
+	httpReqStats map[string]uint64 // 监控端点的请求计数
 
 	clients      map[uint64]*client
-	routes       map[string]*client
+	routes       map[uint64]*client
 	remotes      map[string]*client
 	users        map[string]*User
 	totalClients uint64
 
-	done  chan bool
-	start time.Time
+	done             chan bool
+	shutdownComplete chan struct{} // Shutdown结束后关闭
+	start            time.Time
+
+	// 集群路由
+	routeListener net.Listener
+	routeInfo     Info
+	routeInfoJSON []byte
+	rcQuit        chan bool // 通知正在重连的路由退出
 
 	// Server中的goroutine的的互斥锁
 	grMu      sync.Mutex
 	grRunning bool // Server中的goroutine的状态
-	//grTnpClients map[uint64]*client
-	grWG sync.WaitGroup // to wait on(服侍) various(各种各样的) goroutines
+	// Routes are only registered in s.routes once their INFO is processed,
+	// until then they are tracked here so that Shutdown() can close them.
+	grTmpClients map[uint64]*client
+	grWG         sync.WaitGroup // to wait on(服侍) various(各种各样的) goroutines
 
 	cproto int64 // number of clients supporting async INFO 支持异步信息的客户端数量
+
+	authFailures int64 // 鉴权失败的连接数，原子操作
 	// 日志
 	logging struct {
 		sync.RWMutex
@@ -76,8 +101,69 @@ type stats struct {
 	slowConsumers int64
 }
 
-func New(opt *Options) *Server {
+// New will setup a new server struct after parsing the options.
+func New(opts *Options) *Server {
+	processOptions(opts)
+
+	// Process TLS options, including whether we require client certificates.
+	tlsReq := opts.TLSConfig != nil
+	verify := (tlsReq && opts.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert)
+
+	info := Info{
+		ID:                genID(),
+		Version:           VERSION,
+		GoVersion:         runtime.Version(),
+		Host:              opts.Host,
+		Port:              opts.Port,
+		AuthRequired:      false,
+		TLSRequired:       tlsReq,
+		SSLRequired:       tlsReq,
+		TLSVerify:         verify,
+		MaxPayload:        opts.MaxPayload,
+		ClientConnectURLs: make([]string, 0),
+	}
+
+	s := &Server{
+		configFile: opts.ConfigFile,
+		info:       info,
+		sl:         NewSubList(),
+		opts:       opts,
+		done:       make(chan bool, 1),
+
+		shutdownComplete: make(chan struct{}),
+		start:            time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// For tracking clients
+	s.clients = make(map[uint64]*client)
+
+	// For tracking connections that are not yet registered
+	// in s.routes, but for which readLoop has started.
+	s.grTmpClients = make(map[uint64]*client)
+
+	// For tracking routes and their remote ids
+	s.routes = make(map[uint64]*client)
+	s.remotes = make(map[string]*client)
 
+	// For tracking requests to the monitoring endpoints
+	s.httpReqStats = make(map[string]uint64)
+
+	// Used to kick out all of the route
+	// connect Go routines.
+	s.rcQuit = make(chan bool)
+
+	// Used to setup Authorization.
+	s.configureAuthorization()
+
+	s.generateServerInfoJSON()
+
+	// Setup logging, can be replaced later with SetLogger.
+	s.ConfigureLogger()
+
+	return s
 }
 
 func (s *Server) Start() {
@@ -103,11 +189,16 @@ func (s *Server) Start() {
 		}
 	}
 
+	// Trap the process signals unless the server is embedded.
+	if !opts.NoSigs {
+		s.handleSignals()
+	}
+
 	// Start moitoring(监视) if needed
-	// if err := s.StartMonitoring(); err != nil {
-	// 	s.Fatalf("Can't start monitoring:%v", err)
-	// 	return
-	// }
+	if err := s.StartMonitoring(); err != nil {
+		s.Fatalf("Can't start monitoring: %v", err)
+		return
+	}
 
 	// The Routing goroutine needs to wait for the client listen port to be opened
 	// and potentail(可能存在的) ephemeral(短暂的) port selected
@@ -127,6 +218,12 @@ func (s *Server) Start() {
 
 	// Wait for clients
 	s.AcceptLoop(clientListenReady)
+
+	// The accept loop exits as soon as Shutdown() or lame duck mode closes
+	// the listener, keep the caller blocked until the server is fully down.
+	if !s.isRunning() || s.isLameDuckMode() {
+		<-s.shutdownComplete
+	}
 }
 
 func (s *Server) getOpts() *Options {
@@ -158,7 +255,298 @@ func (s *Server) startGoRoutine(f func()) {
 
 // StartProfiler is called to enable dynamic profiling(描述)
 func (s *Server) StartProfiler() {
+	// Snapshot server options.
+	opts := s.getOpts()
+
+	port := opts.ProfPort
+
+	// Check for Random Port
+	if port == RANDOM_PORT {
+		port = 0
+	}
 
+	hp := net.JoinHostPort(opts.Host, strconv.Itoa(port))
+
+	l, err := net.Listen("tcp", hp)
+	if err != nil {
+		s.Fatalf("error starting profiler: %s", err)
+		return
+	}
+	s.Noticef("profiling port: %d", l.Addr().(*net.TCPAddr).Port)
+
+	// 阻塞和锁竞争的采样默认是关闭的
+	if opts.ProfBlockRate > 0 {
+		runtime.SetBlockProfileRate(opts.ProfBlockRate)
+	}
+	if opts.ProfMutexFraction > 0 {
+		runtime.SetMutexProfileFraction(opts.ProfMutexFraction)
+	}
+
+	// Use our own mux instead of http.DefaultServeMux, pprof.Index serves
+	// the named profiles (heap, goroutine, block, mutex...) itself.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	srv := &http.Server{
+		Addr:           hp,
+		Handler:        mux,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	s.mu.Lock()
+	s.profiler = l
+	s.mu.Unlock()
+
+	go func() {
+		// if this errors out, it's probably because the server is being shutdown
+		err := srv.Serve(l)
+		if err != nil {
+			s.mu.Lock()
+			shutdown := s.shutdown
+			s.mu.Unlock()
+			if !shutdown {
+				s.Fatalf("error starting profiler: %s", err)
+			}
+		}
+		s.done <- true
+	}()
+}
+
+// ProfilerAddr returns the net.Addr object for the profiler listener.
+func (s *Server) ProfilerAddr() *net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.profiler == nil {
+		return nil
+	}
+	return s.profiler.Addr().(*net.TCPAddr)
+}
+
+// generateServerInfoJSON caches the INFO protocol sent to clients.
+// Lock should be held.
+func (s *Server) generateServerInfoJSON() {
+	b, _ := json.Marshal(s.info)
+	s.infoJSON = []byte(fmt.Sprintf(InfoProto, b))
+}
+
+// Update the server's Info object with the given ConnectURLs array
+// and regenerate the infoJSON byte array.
+func (s *Server) updateServerINFO(urls []string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Feature disabled, do not update.
+	if s.getOpts().Cluster.NoAdvertise {
+		return false
+	}
+
+	// Will be set to true if we alter the server's Info object.
+	wasUpdated := false
+	for _, url := range urls {
+		present := false
+		for _, known := range s.info.ClientConnectURLs {
+			if known == url {
+				present = true
+				break
+			}
+		}
+		if !present {
+			s.info.ClientConnectURLs = append(s.info.ClientConnectURLs, url)
+			wasUpdated = true
+		}
+	}
+	if wasUpdated {
+		s.generateServerInfoJSON()
+	}
+	return wasUpdated
+}
+
+// sendAsyncInfoToClients sends an INFO protocol to all
+// connected clients that accept async INFO updates.
+func (s *Server) sendAsyncInfoToClients() {
+	s.mu.Lock()
+	// If there are no clients supporting async INFO protocols, we are done.
+	if s.cproto == 0 || s.shutdown {
+		s.mu.Unlock()
+		return
+	}
+
+	for _, c := range s.clients {
+		c.mu.Lock()
+		// If server did not yet receive the CONNECT protocol, check later
+		// when sending the first PONG.
+		if !c.flags.isSet(connectReceived) {
+			c.flags.set(infoUpdated)
+		} else if c.opts.Protocol >= ClientProtoInfo {
+			// Send only if first PONG was sent
+			if c.flags.isSet(firstPongSent) {
+				// sendInfo takes care of checking if the connection is still
+				// valid or not, so don't duplicate tests here.
+				c.sendInfo(s.infoJSON)
+			} else {
+				// Otherwise, notify that INFO has changed and check later.
+				c.flags.set(infoUpdated)
+			}
+		}
+		c.mu.Unlock()
+	}
+	s.mu.Unlock()
+}
+
+// Returns an array of URLs for clients to connect to.
+func (s *Server) getClientConnectURLs() []string {
+	// Snapshot server options.
+	opts := s.getOpts()
+
+	sPort := strconv.Itoa(opts.Port)
+	urls := make([]string, 0, 1)
+
+	ipAddr, err := net.ResolveIPAddr("ip", opts.Host)
+	// If the host is "any" (0.0.0.0 or ::), get specific IPs from available
+	// interfaces.
+	if err == nil && ipAddr.IP.IsUnspecified() {
+		var ip net.IP
+		ifaces, _ := net.Interfaces()
+		for _, i := range ifaces {
+			addrs, _ := i.Addrs()
+			for _, addr := range addrs {
+				switch v := addr.(type) {
+				case *net.IPNet:
+					ip = v.IP
+				case *net.IPAddr:
+					ip = v.IP
+				}
+				// Skip non global unicast addresses
+				if !ip.IsGlobalUnicast() || ip.IsUnspecified() {
+					ip = nil
+					continue
+				}
+				urls = append(urls, net.JoinHostPort(ip.String(), sPort))
+			}
+		}
+	}
+	if err != nil || len(urls) == 0 {
+		// We are here if opts.Host is not "0.0.0.0" nor "::", or if for some
+		// reason we could not add any URL in the loop above.
+		if opts.Host == "0.0.0.0" || opts.Host == "::" {
+			s.Errorf("Address %q can not be resolved properly", opts.Host)
+		} else {
+			urls = append(urls, net.JoinHostPort(opts.Host, sPort))
+		}
+	}
+	return urls
+}
+
+// NumClients will report the number of registered clients.
+func (s *Server) NumClients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+func (s *Server) isLameDuckMode() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ldm
+}
+
+// lameDuckMode stops accepting new clients, tells the connected ones through
+// an async INFO that this server is going away and then closes them in
+// batches spread over LameDuckDuration before shutting the server down.
+// This keeps clients from reconnecting to the rest of the cluster all at once.
+func (s *Server) lameDuckMode() {
+	s.mu.Lock()
+	// Check if there is actually anything to do
+	if s.shutdown || s.ldm || s.listener == nil {
+		s.mu.Unlock()
+		return
+	}
+	s.Noticef("Entering lame duck mode, stop accepting new clients")
+	s.ldm = true
+	s.listener.Close()
+	s.listener = nil
+	s.mu.Unlock()
+
+	// Wait for the client AcceptLoop() to be done to make sure
+	// that no new client can connect.
+	<-s.done
+
+	s.mu.Lock()
+	// Need to recheck few things
+	if s.shutdown || len(s.clients) == 0 {
+		s.mu.Unlock()
+		// If server has been shutdown while lock was released,
+		// Shutdown() only waits for it to complete.
+		s.Shutdown()
+		return
+	}
+
+	dur := int64(s.getOpts().LameDuckDuration)
+	numClients := int64(len(s.clients))
+	batch := 1
+	// Sleep interval between each client connection close.
+	si := dur / numClients
+	if si < 1 {
+		// Too many clients for the duration, close them in batches
+		// with a tiny sleep interval in between.
+		si = 1
+		batch = int(numClients / dur)
+	} else if si > int64(time.Second) {
+		// No need to sleep more than a second between clients.
+		si = int64(time.Second)
+	}
+
+	// Now capture all clients
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+
+	// Let the clients know that they should go elsewhere.
+	s.info.LameDuckMode = true
+	s.generateServerInfoJSON()
+	s.mu.Unlock()
+
+	s.sendAsyncInfoToClients()
+
+	s.Noticef("Closing %d existing clients over %v", numClients, time.Duration(dur))
+	t := time.NewTimer(time.Duration(si))
+	defer t.Stop()
+	for i, c := range clients {
+		c.closeConnection()
+		if i == len(clients)-1 {
+			break
+		}
+		if batch == 1 || i%batch == 0 {
+			// We pick a random interval which will be at least si/2
+			v := rand.Int63n(si)
+			if v < si/2 {
+				v = si / 2
+			}
+			t.Reset(time.Duration(v))
+			// Sleep for given interval or bail out if kicked by Shutdown().
+			select {
+			case <-t.C:
+			case <-s.rcQuit:
+				return
+			}
+		}
+	}
+	s.Shutdown()
+}
+
+// Addr will return the net.Addr object for the current listener.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
 }
 
 func (s *Server) isRunning() bool {
@@ -185,7 +573,7 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 	// 开启对服务端口的监听
 	hp := net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port))
 	l, err := net.Listen("tcp", hp)
-	if e != nil {
+	if err != nil {
 		s.Fatalf("Error listening on port:%s, %q", hp, err)
 		return
 	}
@@ -242,6 +630,9 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 				if tmpDelay > ACCEPT_MAX_SLEEP {
 					tmpDelay = ACCEPT_MAX_SLEEP
 				}
+			} else if s.isLameDuckMode() {
+				// The listener was closed to stop accepting new clients.
+				break
 			} else if s.isRunning() {
 				s.Noticef("Accept error: %v", err)
 			}
@@ -313,8 +704,31 @@ func (s *Server) createClinet(conn net.Conn) *client {
 	c.mu.Lock()
 
 	// Check for TLS
+	// INFO已经以明文发出，这里把连接升级为TLS并强制完成握手
 	if tlsRequired {
+		c.Debugf("Starting TLS client connection handshake")
+		c.nc = tls.Server(c.nc, opts.TLSConfig)
+		conn := c.nc.(*tls.Conn)
+
+		// Setup the timeout
+		time.AfterFunc(TLS_TIMEOUT, func() { tlsTimeout(c, conn) })
+		conn.SetReadDeadline(time.Now().Add(TLS_TIMEOUT))
+
+		// Force handshake
+		c.mu.Unlock()
+		if err := conn.Handshake(); err != nil {
+			c.Debugf("TLS handshake error: %v", err)
+			// c.bw still wraps the plain connection, so a client that
+			// does not speak TLS will be able to read this.
+			c.sendErr("Secure Connection - TLS Required")
+			c.closeConnection()
+			return nil
+		}
+		// Reset the read deadline
+		conn.SetReadDeadline(time.Time{})
 
+		// Re-Grab lock
+		c.mu.Lock()
 	}
 
 	// The connection may have been closed
@@ -327,11 +741,12 @@ func (s *Server) createClinet(conn net.Conn) *client {
 	// the race where the timer fires during the handshake and causes the
 	// server to write bad data to the socket.
 	if authRequired {
-
+		c.setAuthTimer(AUTH_TIMEOUT)
 	}
 
 	if tlsRequired {
-
+		// Rewrap bw
+		c.bw = bufio.NewWriterSize(c.nc, startBufSize)
 	}
 
 	// Do final client initialization
@@ -344,7 +759,9 @@ func (s *Server) createClinet(conn net.Conn) *client {
 	})
 
 	if tlsRequired {
-
+		c.Debugf("TLS handshake complete")
+		cs := c.nc.(*tls.Conn).ConnectionState()
+		c.Debugf("TLS version %s, cipher suite %s", tlsVersion(cs.Version), tlsCipher(cs.CipherSuite))
 	}
 
 	c.mu.Unlock()
@@ -353,6 +770,175 @@ func (s *Server) createClinet(conn net.Conn) *client {
 
 }
 
+// removeClient unregisters a client or route from the server.
+func (s *Server) removeClient(c *client) {
+	var rID string
+	c.mu.Lock()
+	cid := c.cid
+	typ := c.typ
+	r := c.route
+	if r != nil {
+		rID = r.remoteID
+	}
+	updateProtoInfoCount := false
+	if typ == CLIENT && c.opts.Protocol >= ClientProtoInfo {
+		updateProtoInfoCount = true
+	}
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	switch typ {
+	case CLIENT:
+		delete(s.clients, cid)
+		if updateProtoInfoCount {
+			s.cproto--
+		}
+	case ROUTER:
+		delete(s.routes, cid)
+		if r != nil {
+			rc, ok := s.remotes[rID]
+			// Only delete it if it is us..
+			if ok && c == rc {
+				delete(s.remotes, rID)
+			}
+		}
+		// The route may have been closed before its INFO was processed.
+		s.grMu.Lock()
+		delete(s.grTmpClients, cid)
+		s.grMu.Unlock()
+	}
+	s.mu.Unlock()
+}
+
+// Handle closing down a connection when the handshake has timedout.
+func tlsTimeout(c *client, conn *tls.Conn) {
+	c.mu.Lock()
+	nc := c.nc
+	c.mu.Unlock()
+	// Check if already closed
+	if nc == nil {
+		return
+	}
+	cs := conn.ConnectionState()
+	if !cs.HandshakeComplete {
+		c.Debugf("TLS handshake timeout")
+		c.sendErr("Secure Connection - TLS Required")
+		c.closeConnection()
+	}
+}
+
+// tlsVersion returns a readable name for the negotiated TLS version.
+func tlsVersion(ver uint16) string {
+	switch ver {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+	return fmt.Sprintf("Unknown [%x]", ver)
+}
+
+// tlsCipher returns a readable name for the negotiated cipher suite.
+func tlsCipher(cs uint16) string {
+	return tls.CipherSuiteName(cs)
+}
+
+// Shutdown will shutdown the server instance by kicking out the AcceptLoop
+// and closing all associated clients and routes. It only returns once the
+// accept loops and all tracked goroutines are done, concurrent callers
+// wait for the first one to complete.
 func (s *Server) Shutdown() {
+	s.mu.Lock()
+
+	// Prevent issues with multiple calls.
+	if s.shutdown {
+		s.mu.Unlock()
+		<-s.shutdownComplete
+		return
+	}
+
+	s.shutdown = true
+	s.running = false
+	s.grMu.Lock()
+	s.grRunning = false
+	s.grMu.Unlock()
+
+	conns := make(map[uint64]*client)
+
+	// Copy off the clients
+	for i, c := range s.clients {
+		conns[i] = c
+	}
+	// Copy off the connections that are not yet registered
+	// in s.routes, but for which the readLoop has started
+	for i, c := range s.grTmpClients {
+		conns[i] = c
+	}
+	// Copy off the routes
+	for i, r := range s.routes {
+		conns[i] = r
+	}
+
+	// Number of done channel responses we expect.
+	doneExpected := 0
+
+	// Kick client AcceptLoop()
+	if s.listener != nil {
+		doneExpected++
+		s.listener.Close()
+		s.listener = nil
+	}
+
+	// Kick route AcceptLoop()
+	if s.routeListener != nil {
+		doneExpected++
+		s.routeListener.Close()
+		s.routeListener = nil
+	}
+
+	// Kick HTTP monitoring if its running
+	if s.http != nil {
+		doneExpected++
+		s.http.Close()
+		s.http = nil
+	}
+
+	// Kick Profiling if its running
+	if s.profiler != nil {
+		doneExpected++
+		s.profiler.Close()
+		s.profiler = nil
+	}
+
+	// Release the solicited routes connect go routines.
+	close(s.rcQuit)
+
+	s.mu.Unlock()
+
+	// Close client and route connections
+	for _, c := range conns {
+		c.closeConnection()
+	}
+
+	// Block until the accept loops exit
+	for doneExpected > 0 {
+		<-s.done
+		doneExpected--
+	}
+
+	// Wait for go routines to be done.
 	s.grWG.Wait()
+
+	// The pid file is only meaningful while the server runs.
+	if pidFile := s.getOpts().PidFile; pidFile != _EMPTY_ {
+		if err := os.Remove(pidFile); err != nil && !os.IsNotExist(err) {
+			s.Errorf("Error removing pid file %q: %v", pidFile, err)
+		}
+	}
+
+	close(s.shutdownComplete)
 }
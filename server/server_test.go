@@ -0,0 +1,524 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewServerDefaults(t *testing.T) {
+	s := New(&Options{})
+	opts := s.getOpts()
+
+	if opts.Host != DEFAULT_HOST {
+		t.Fatalf("Expected host %q, got %q", DEFAULT_HOST, opts.Host)
+	}
+	if opts.Port != DEFAULT_PORT {
+		t.Fatalf("Expected port %d, got %d", DEFAULT_PORT, opts.Port)
+	}
+	if opts.MaxPayload != MAX_PAYLOAD_SIZE {
+		t.Fatalf("Expected max payload %d, got %d", MAX_PAYLOAD_SIZE, opts.MaxPayload)
+	}
+	if opts.PingInterval != DEFAULT_PING_INTERVAL {
+		t.Fatalf("Expected ping interval %v, got %v", DEFAULT_PING_INTERVAL, opts.PingInterval)
+	}
+	if opts.MaxPingsOut != DEFAULT_PING_MAX_OUT {
+		t.Fatalf("Expected max pings out %d, got %d", DEFAULT_PING_MAX_OUT, opts.MaxPingsOut)
+	}
+	if opts.WriteDeadline != DEFAULT_FLUSH_DEADLINE {
+		t.Fatalf("Expected write deadline %v, got %v", DEFAULT_FLUSH_DEADLINE, opts.WriteDeadline)
+	}
+	if opts.MaxPending != MAX_PENDING_SIZE {
+		t.Fatalf("Expected max pending %d, got %d", MAX_PENDING_SIZE, opts.MaxPending)
+	}
+	if opts.LameDuckDuration != DEFAULT_LAME_DUCK_DURATION {
+		t.Fatalf("Expected lame duck duration %v, got %v", DEFAULT_LAME_DUCK_DURATION, opts.LameDuckDuration)
+	}
+	if s.clients == nil || s.routes == nil || s.remotes == nil || s.sl == nil {
+		t.Fatal("Expected server maps and sublist to be initialized")
+	}
+
+	// A negative lame duck duration would leave no time for each batch.
+	s = New(&Options{LameDuckDuration: -time.Second})
+	if d := s.getOpts().LameDuckDuration; d != DEFAULT_LAME_DUCK_DURATION {
+		t.Fatalf("Expected lame duck duration %v, got %v", DEFAULT_LAME_DUCK_DURATION, d)
+	}
+}
+
+func TestNewServerInfoJSON(t *testing.T) {
+	s := New(&Options{Port: 4321, MaxPayload: 1024})
+	js := string(s.infoJSON)
+	if !strings.HasPrefix(js, "INFO ") || !strings.HasSuffix(js, CR_LF) {
+		t.Fatalf("Unexpected INFO protocol: %q", js)
+	}
+	var info Info
+	if err := json.Unmarshal([]byte(strings.TrimSuffix(js[5:], CR_LF)), &info); err != nil {
+		t.Fatalf("Could not unmarshal INFO: %v", err)
+	}
+	if info.ID == "" || info.Port != 4321 || info.MaxPayload != 1024 {
+		t.Fatalf("Unexpected info: %+v", info)
+	}
+	if id := New(&Options{}).info.ID; id == info.ID {
+		t.Fatalf("Expected unique server IDs, got %q twice", id)
+	}
+}
+
+func TestShutdownStopsServer(t *testing.T) {
+	s := New(&Options{Port: RANDOM_PORT, NoSigs: true})
+	s.SetLogger(nil, false, false)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Start()
+		close(stopped)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Addr() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Server did not start listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	addr := s.Addr().String()
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Could not connect to server: %v", err)
+	}
+	defer nc.Close()
+
+	s.Shutdown()
+	// Must be safe to call more than once.
+	s.Shutdown()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start did not return after Shutdown")
+	}
+	if s.isRunning() {
+		t.Fatal("Expected server to not be running")
+	}
+	if n := s.NumClients(); n != 0 {
+		t.Fatalf("Expected no clients after Shutdown, got %d", n)
+	}
+	if _, err := net.DialTimeout("tcp", addr, 250*time.Millisecond); err == nil {
+		t.Fatal("Expected connection to be refused after Shutdown")
+	}
+}
+
+func TestConcurrentShutdownWaits(t *testing.T) {
+	srvA := runClusterServer(t, ClusterOpts{})
+	srvB := runClusterServer(t, ClusterOpts{}, routeURL(t, srvA, ""))
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+	for i := 0; i < 5; i++ {
+		c := newTestConn(t, srvA)
+		defer c.close()
+	}
+
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			srvA.Shutdown()
+			// Every caller must only return once shutdown has completed.
+			select {
+			case <-srvA.shutdownComplete:
+				errs <- nil
+			default:
+				errs <- fmt.Errorf("Shutdown returned before completing")
+			}
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLameDuckMode(t *testing.T) {
+	const ldmDuration = 200 * time.Millisecond
+	s := New(&Options{Port: RANDOM_PORT, LameDuckDuration: ldmDuration, NoSigs: true})
+	s.SetLogger(nil, false, false)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Start()
+		close(stopped)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Addr() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Server did not start listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	addr := s.Addr().String()
+
+	const total = 5
+	for i := 0; i < total; i++ {
+		nc, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Could not connect to server: %v", err)
+		}
+		defer nc.Close()
+	}
+	for s.NumClients() != total {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d clients, got %d", total, s.NumClients())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	go s.lameDuckMode()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Server did not shut down after lame duck mode")
+	}
+	// Clients are closed one by one, at least half of the per client
+	// interval apart.
+	minDur := (total - 1) * (ldmDuration / total) / 2
+	if dur := time.Since(start); dur < minDur {
+		t.Fatalf("Expected clients to be closed over at least %v, took %v", minDur, dur)
+	}
+	if _, err := net.DialTimeout("tcp", addr, 250*time.Millisecond); err == nil {
+		t.Fatal("Expected connection to be refused in lame duck mode")
+	}
+	if n := s.NumClients(); n != 0 {
+		t.Fatalf("Expected no clients, got %d", n)
+	}
+}
+
+func TestSlowConsumerMaxPending(t *testing.T) {
+	// Keep the WriteDeadline well past the test timeout so only MaxPending
+	// can catch the subscriber.
+	s := runServer(t, &Options{MaxPending: 1024, WriteDeadline: 10 * time.Second})
+	defer s.Shutdown()
+
+	// A subscriber that never reads.
+	sub := newTestConn(t, s)
+	defer sub.close()
+	sub.connect(`{"verbose":false}`)
+	sub.send("SUB foo 1\r\n")
+	sub.flush()
+
+	pub := newTestConn(t, s)
+	defer pub.close()
+	pub.connect(`{"verbose":false}`)
+
+	// Publish small messages until the subscriber gets disconnected.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		batch := strings.Repeat("PUB foo 5\r\nhello\r\n", 100)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			pub.nc.SetWriteDeadline(time.Now().Add(2 * time.Second))
+			if _, err := pub.nc.Write([]byte(batch)); err != nil {
+				return
+			}
+		}
+	}()
+
+	checkFor(t, 5*time.Second, func() error {
+		if sc := atomic.LoadInt64(&s.slowConsumers); sc != 1 {
+			return fmt.Errorf("Expected 1 slow consumer, got %d", sc)
+		}
+		if n := s.NumClients(); n != 1 {
+			return fmt.Errorf("Expected only the publisher to remain, got %d clients", n)
+		}
+		return nil
+	})
+}
+
+func TestSlowConsumerWriteDeadline(t *testing.T) {
+	s := runServer(t, &Options{WriteDeadline: 10 * time.Millisecond})
+	defer s.Shutdown()
+
+	// A subscriber that never reads, with as little buffering as we can get.
+	sub := newTestConn(t, s)
+	defer sub.close()
+	sub.nc.(*net.TCPConn).SetReadBuffer(1024)
+	sub.connect(`{"verbose":false}`)
+	sub.send("SUB foo 1\r\n")
+	sub.flush()
+
+	pub := newTestConn(t, s)
+	defer pub.close()
+	pub.connect(`{"verbose":false}`)
+
+	// Publish until the subscriber gets disconnected.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		payload := strings.Repeat("a", 64*1024)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			pub.nc.SetWriteDeadline(time.Now().Add(2 * time.Second))
+			if _, err := fmt.Fprintf(pub.nc, "PUB foo %d\r\n%s\r\n", len(payload), payload); err != nil {
+				return
+			}
+		}
+	}()
+
+	checkFor(t, 5*time.Second, func() error {
+		if sc := atomic.LoadInt64(&s.slowConsumers); sc != 1 {
+			return fmt.Errorf("Expected 1 slow consumer, got %d", sc)
+		}
+		if n := s.NumClients(); n != 1 {
+			return fmt.Errorf("Expected only the publisher to remain, got %d clients", n)
+		}
+		return nil
+	})
+}
+
+// checkFor polls f until it returns nil or the timeout expires.
+func checkFor(t *testing.T, timeout time.Duration, f func() error) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := f()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// runServer starts a server on random loopback ports and waits for its
+// client listener, and its route listener when clustering is enabled.
+func runServer(t *testing.T, opts *Options) *Server {
+	t.Helper()
+	opts.Host = "127.0.0.1"
+	opts.Port = RANDOM_PORT
+	opts.NoSigs = true
+	clustered := opts.Cluster.Port != 0
+	monitored := opts.HTTPPort != 0
+	s := New(opts)
+	s.SetLogger(nil, false, false)
+	go s.Start()
+
+	checkFor(t, 2*time.Second, func() error {
+		if s.Addr() == nil {
+			return fmt.Errorf("Server did not start listening")
+		}
+		if clustered && s.clusterAddr() == nil {
+			return fmt.Errorf("Server did not start listening for routes")
+		}
+		if monitored && s.MonitorAddr() == nil {
+			return fmt.Errorf("Server did not start listening for monitoring")
+		}
+		return nil
+	})
+	return s
+}
+
+// clusterAddr returns the address of the route listener, if any.
+func (s *Server) clusterAddr() *net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.routeListener == nil {
+		return nil
+	}
+	return s.routeListener.Addr().(*net.TCPAddr)
+}
+
+// testConn is a raw protocol connection to a server.
+type testConn struct {
+	t  *testing.T
+	nc net.Conn
+	br *bufio.Reader
+}
+
+// newTestConn dials the server and consumes its INFO.
+func newTestConn(t *testing.T, s *Server) *testConn {
+	t.Helper()
+	nc, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect to server: %v", err)
+	}
+	c := &testConn{t: t, nc: nc, br: bufio.NewReader(nc)}
+	c.expect("INFO ")
+	return c
+}
+
+// connect sends CONNECT with the given JSON and waits for the PONG.
+func (c *testConn) connect(js string) {
+	c.t.Helper()
+	c.send("CONNECT %s\r\nPING\r\n", js)
+	c.expect("PONG")
+}
+
+func (c *testConn) send(format string, args ...interface{}) {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.nc, format, args...); err != nil {
+		c.t.Fatalf("Error writing to server: %v", err)
+	}
+}
+
+// flush round trips a PING so that everything sent before was processed.
+func (c *testConn) flush() {
+	c.t.Helper()
+	c.send("PING\r\n")
+	c.expect("PONG")
+}
+
+func (c *testConn) readLine() string {
+	c.t.Helper()
+	c.nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("Error reading from server: %v", err)
+	}
+	return strings.TrimSuffix(line, CR_LF)
+}
+
+func (c *testConn) expect(prefix string) string {
+	c.t.Helper()
+	line := c.readLine()
+	if !strings.HasPrefix(line, prefix) {
+		c.t.Fatalf("Expected %q, got %q", prefix, line)
+	}
+	return line
+}
+
+// expectMsg reads a MSG and checks its subject, sid and payload.
+func (c *testConn) expectMsg(subject, sid, payload string) []string {
+	c.t.Helper()
+	args := strings.Fields(c.expect("MSG "))
+	if len(args) < 4 || args[1] != subject || args[2] != sid {
+		c.t.Fatalf("Unexpected MSG %q, expected subject %q and sid %q", args, subject, sid)
+	}
+	if got := c.readLine(); got != payload {
+		c.t.Fatalf("Expected payload %q, got %q", payload, got)
+	}
+	return args
+}
+
+// expectClosed checks that the server closed the connection.
+func (c *testConn) expectClosed() {
+	c.t.Helper()
+	c.nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, err := c.br.ReadString('\n'); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				c.t.Fatal("Expected the connection to be closed")
+			}
+			return
+		}
+	}
+}
+
+func (c *testConn) close() {
+	c.nc.Close()
+}
+
+// testTLSConfig returns a server TLS config with a self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+func TestTLSClientHandshake(t *testing.T) {
+	s := runServer(t, &Options{TLS: true, TLSConfig: testTLSConfig(t)})
+	defer s.Shutdown()
+
+	// INFO is sent in the clear and asks for TLS.
+	c := newTestConn(t, s)
+	defer c.close()
+	if !s.info.TLSRequired {
+		t.Fatal("Expected TLS to be required")
+	}
+
+	tc := tls.Client(c.nc, &tls.Config{InsecureSkipVerify: true})
+	tc.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	sc := &testConn{t: t, nc: tc, br: bufio.NewReader(tc)}
+	sc.connect(`{"verbose":false}`)
+	if n := s.NumClients(); n != 1 {
+		t.Fatalf("Expected 1 client, got %d", n)
+	}
+}
+
+func TestTLSHandshakeFailure(t *testing.T) {
+	s := runServer(t, &Options{TLS: true, TLSConfig: testTLSConfig(t)})
+	defer s.Shutdown()
+
+	// A client that does not speak TLS gets a clean rejection.
+	c := newTestConn(t, s)
+	defer c.close()
+	c.send("CONNECT {\"verbose\":false}\r\nPING\r\n")
+	c.expect("-ERR 'Secure Connection - TLS Required'")
+	c.expectClosed()
+	checkFor(t, 2*time.Second, func() error {
+		if n := s.NumClients(); n != 0 {
+			return fmt.Errorf("Expected no clients, got %d", n)
+		}
+		return nil
+	})
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	s := runServer(t, &Options{TLS: true, TLSConfig: testTLSConfig(t)})
+	defer s.Shutdown()
+
+	// Never start the handshake.
+	c := newTestConn(t, s)
+	defer c.close()
+	start := time.Now()
+	c.expect("-ERR 'Secure Connection - TLS Required'")
+	if d := time.Since(start); d < TLS_TIMEOUT/2 {
+		t.Fatalf("TLS timeout fired too early: %v", d)
+	}
+	c.expectClosed()
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// handleSignals sets up the handlers for the process signals:
+// SIGINT/SIGTERM stop the server, SIGUSR1 re-opens the log file,
+// SIGHUP reloads the configuration and SIGUSR2 enters lame duck mode.
+func (s *Server) handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGHUP, syscall.SIGUSR2)
+
+	go func() {
+		for {
+			select {
+			case sig := <-c:
+				s.Debugf("Trapped %q signal", sig)
+				switch sig {
+				case syscall.SIGINT, syscall.SIGTERM:
+					s.Noticef("Server Exiting..")
+					s.Shutdown()
+					os.Exit(0)
+				case syscall.SIGUSR1:
+					// File log re-open for rotating file logs.
+					s.ReOpenLogFile()
+				case syscall.SIGHUP:
+					// Config reload.
+					if err := s.Reload(); err != nil {
+						s.Errorf("Failed to reload server configuration: %s", err)
+					}
+				case syscall.SIGUSR2:
+					go s.lameDuckMode()
+				}
+			case <-s.rcQuit:
+				signal.Stop(c)
+				return
+			}
+		}
+	}()
+}
+
+// ProcessSignal sends the given signal command to the running server.
+// pidStr is either a pid or the path of a pid file, as written by the
+// server when PidFile is set.
+func ProcessSignal(command Command, pidStr string) error {
+	pid, err := resolvePid(pidStr)
+	if err != nil {
+		return err
+	}
+	sig, err := commandToSignal(command)
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// resolvePid returns the pid given directly or read from a pid file.
+func resolvePid(pidStr string) (int, error) {
+	if pidStr == _EMPTY_ {
+		return 0, errors.New("no pid or pid file given")
+	}
+	pid, err := strconv.Atoi(pidStr)
+	if err == nil {
+		return pid, nil
+	}
+	// 不是数字则当作pid文件的路径
+	b, err := ioutil.ReadFile(pidStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid or pid file %q: %v", pidStr, err)
+	}
+	pid, err = strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid in pid file %q: %v", pidStr, err)
+	}
+	return pid, nil
+}
+
+// commandToSignal maps a signal command to the signal handled by the
+// server, see handleSignals.
+func commandToSignal(command Command) (syscall.Signal, error) {
+	switch command {
+	case CommandStop:
+		return syscall.SIGTERM, nil
+	case CommandQuit:
+		return syscall.SIGINT, nil
+	case CommandReopen:
+		return syscall.SIGUSR1, nil
+	case CommandReload:
+		return syscall.SIGHUP, nil
+	case CommandLDMode:
+		return syscall.SIGUSR2, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", command)
+}
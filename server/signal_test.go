@@ -0,0 +1,88 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestResolvePid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gnatsd")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pidFile := filepath.Join(dir, "gnatsd.pid")
+	if err := ioutil.WriteFile(pidFile, []byte("1234\n"), 0644); err != nil {
+		t.Fatalf("Could not write pid file: %v", err)
+	}
+	badFile := filepath.Join(dir, "bad.pid")
+	if err := ioutil.WriteFile(badFile, []byte("nope"), 0644); err != nil {
+		t.Fatalf("Could not write pid file: %v", err)
+	}
+
+	for _, pidStr := range []string{"1234", pidFile} {
+		pid, err := resolvePid(pidStr)
+		if err != nil || pid != 1234 {
+			t.Fatalf("Resolving %q: expected pid 1234, got %d, %v", pidStr, pid, err)
+		}
+	}
+	for _, pidStr := range []string{"", badFile, filepath.Join(dir, "missing.pid")} {
+		if _, err := resolvePid(pidStr); err == nil {
+			t.Fatalf("Expected an error resolving %q", pidStr)
+		}
+	}
+}
+
+func TestCommandToSignal(t *testing.T) {
+	for command, expected := range map[Command]syscall.Signal{
+		CommandStop:   syscall.SIGTERM,
+		CommandQuit:   syscall.SIGINT,
+		CommandReopen: syscall.SIGUSR1,
+		CommandReload: syscall.SIGHUP,
+		CommandLDMode: syscall.SIGUSR2,
+	} {
+		sig, err := commandToSignal(command)
+		if err != nil || sig != expected {
+			t.Fatalf("Command %q: expected %v, got %v, %v", command, expected, sig, err)
+		}
+	}
+	if _, err := commandToSignal(Command("kill")); err == nil {
+		t.Fatal("Expected an error for an unknown command")
+	}
+}
+
+func TestProcessSignalPidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gnatsd")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "gnatsd.pid")
+	if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		t.Fatalf("Could not write pid file: %v", err)
+	}
+
+	// Trap the signal ourselves so it does not affect the test binary.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	defer signal.Stop(c)
+
+	if err := ProcessSignal(CommandReopen, pidFile); err != nil {
+		t.Fatalf("Could not send signal: %v", err)
+	}
+	select {
+	case sig := <-c:
+		if sig != syscall.SIGUSR1 {
+			t.Fatalf("Expected %v, got %v", syscall.SIGUSR1, sig)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Did not receive the signal")
+	}
+}
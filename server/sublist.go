@@ -1,8 +1,11 @@
 package server
 
 import (
+	"bytes"
 	"errors"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // Common byte variables for wildcards and token separator
@@ -19,6 +22,13 @@ var (
 	ErrNotFound       = errors.New("sublist: No Matches Found")
 )
 
+// Match cache bounds. When the number of cached results grows past
+// slCacheMax, entries are swept until we are back down to slCacheSweep.
+const (
+	slCacheMax   = 1024
+	slCacheSweep = 256
+)
+
 // A Sublist stores and efficiently(有效地) retrieves(检索) subscriptions(订阅).
 type Sublist struct {
 	sync.RWMutex
@@ -41,7 +51,7 @@ type SublistResult struct {
 // A node contains subscriptions and a poiter to the next level
 type node struct {
 	next  *level
-	psubs []subscription
+	psubs []*subscription
 	qsubs [][]*subscription
 }
 
@@ -52,7 +62,7 @@ type level struct {
 }
 
 func newNode() *node {
-	return &node{psubs: make([]subscription, 0, 4)}
+	return &node{psubs: make([]*subscription, 0, 4)}
 }
 
 func newLevel() *level {
@@ -63,7 +73,597 @@ func NewSubList() *Sublist {
 	return &Sublist{root: newLevel(), cache: make(map[string]*SublistResult)}
 }
 
+// tokenizeSubject splits a subject into its tokens using the
+// provided slice as backing storage to avoid allocations.
+func tokenizeSubject(tokens []string, subject string) []string {
+	start := 0
+	for i := 0; i < len(subject); i++ {
+		if subject[i] == btsep {
+			tokens = append(tokens, subject[start:i])
+			start = i + 1
+		}
+	}
+	return append(tokens, subject[start:])
+}
+
 // Insert adds a subscription into the sublist
 func (s *Sublist) Insert(sub *subscription) error {
-	// TODO
+	// copy the subject since we hold this and this might be part of a large byte slice.
+	subject := string(sub.subject)
+	tsa := [32]string{}
+	tokens := tokenizeSubject(tsa[:0], subject)
+
+	s.Lock()
+
+	sfwc := false
+	l := s.root
+	var n *node
+
+	// 逐个token向下构建前缀树，'*'和'>'分别挂在level的pwc和fwc上
+	for _, t := range tokens {
+		lt := len(t)
+		// '>' must be the last token
+		if lt == 0 || sfwc {
+			s.Unlock()
+			return ErrInvalidSubject
+		}
+
+		if lt > 1 {
+			n = l.nodes[t]
+		} else {
+			switch t[0] {
+			case pwc:
+				n = l.pwc
+			case fwc:
+				n = l.fwc
+				sfwc = true
+			default:
+				n = l.nodes[t]
+			}
+		}
+		if n == nil {
+			n = newNode()
+			if lt > 1 {
+				l.nodes[t] = n
+			} else {
+				switch t[0] {
+				case pwc:
+					l.pwc = n
+				case fwc:
+					l.fwc = n
+				default:
+					l.nodes[t] = n
+				}
+			}
+		}
+		if n.next == nil {
+			n.next = newLevel()
+		}
+		l = n.next
+	}
+	if sub.queue == nil {
+		n.psubs = append(n.psubs, sub)
+	} else {
+		// This is a queue subscription
+		if i := findQSliceForSub(sub, n.qsubs); i >= 0 {
+			n.qsubs[i] = append(n.qsubs[i], sub)
+		} else {
+			n.qsubs = append(n.qsubs, []*subscription{sub})
+		}
+	}
+
+	s.count++
+	s.inserts++
+
+	s.addToCache(subject, sub)
+	atomic.AddUint64(&s.genid, 1)
+
+	s.Unlock()
+	return nil
+}
+
+// Deep copy
+func copyResult(r *SublistResult) *SublistResult {
+	nr := &SublistResult{}
+	nr.psubs = append([]*subscription(nil), r.psubs...)
+	for _, qr := range r.qsubs {
+		nqr := append([]*subscription(nil), qr...)
+		nr.qsubs = append(nr.qsubs, nqr)
+	}
+	return nr
+}
+
+// addToCache will add the new entry to existing cache
+// entries if needed. Assumes write lock is held.
+//
+// A literal subject can only affect the cache entry with the same key, so that
+// result is updated in place. A wildcard subscription may match any number of
+// cached subjects, in which case the matching entries are invalidated and will
+// be re-populated on the next Match.
+func (s *Sublist) addToCache(subject string, sub *subscription) {
+	if subjectIsLiteral(subject) {
+		r, ok := s.cache[subject]
+		if !ok {
+			return
+		}
+		// Copy since others may have a reference.
+		nr := copyResult(r)
+		if sub.queue == nil {
+			nr.psubs = append(nr.psubs, sub)
+		} else {
+			if i := findQSliceForSub(sub, nr.qsubs); i >= 0 {
+				nr.qsubs[i] = append(nr.qsubs[i], sub)
+			} else {
+				nr.qsubs = append(nr.qsubs, []*subscription{sub})
+			}
+		}
+		s.cache[subject] = nr
+		return
+	}
+	for k := range s.cache {
+		if matchLiteral(k, subject) {
+			delete(s.cache, k)
+		}
+	}
+}
+
+// removeFromCache will remove the sub from any active cache entries.
+// Assumes write lock is held.
+func (s *Sublist) removeFromCache(subject string, sub *subscription) {
+	for k := range s.cache {
+		if !matchLiteral(k, subject) {
+			continue
+		}
+		// Since someone else may be referecing, can't modify the list
+		// safely, just let it re-populate.
+		delete(s.cache, k)
+	}
+}
+
+// Match will match all entries to the literal subject.
+// It will return a set of results for both normal and queue subscribers.
+func (s *Sublist) Match(subject string) *SublistResult {
+	s.RLock()
+	atomic.AddUint64(&s.matches, 1)
+	rc, ok := s.cache[subject]
+	s.RUnlock()
+	if ok {
+		atomic.AddUint64(&s.cacheHits, 1)
+		return rc
+	}
+
+	tsa := [32]string{}
+	tokens := tokenizeSubject(tsa[:0], subject)
+
+	result := &SublistResult{}
+
+	s.Lock()
+	matchLevel(s.root, tokens, result)
+
+	// Add to our cache
+	s.cache[subject] = result
+	// Bound the number of entries to slCacheMax
+	if len(s.cache) > slCacheMax {
+		s.reduceCacheCount()
+	}
+	s.Unlock()
+
+	return result
+}
+
+// reduceCacheCount sweeps the cache until we are under slCacheSweep entries.
+// Map iteration order is random so this evicts arbitrary entries.
+// Assumes write lock is held.
+func (s *Sublist) reduceCacheCount() {
+	for k := range s.cache {
+		if len(s.cache) <= slCacheSweep {
+			break
+		}
+		delete(s.cache, k)
+	}
+}
+
+// matchLevel is used to recursively descend into the trie.
+func matchLevel(l *level, toks []string, results *SublistResult) {
+	var pwc, n *node
+	for i, t := range toks {
+		if l == nil {
+			return
+		}
+		if l.fwc != nil {
+			addNodeToResults(l.fwc, results)
+		}
+		if pwc = l.pwc; pwc != nil {
+			matchLevel(pwc.next, toks[i+1:], results)
+		}
+		n = l.nodes[t]
+		if n != nil {
+			l = n.next
+		} else {
+			l = nil
+		}
+	}
+	if n != nil {
+		addNodeToResults(n, results)
+	}
+	if pwc != nil {
+		addNodeToResults(pwc, results)
+	}
+}
+
+// This will add in a node's results to the total results.
+func addNodeToResults(n *node, results *SublistResult) {
+	results.psubs = append(results.psubs, n.psubs...)
+	for _, qr := range n.qsubs {
+		if len(qr) == 0 {
+			continue
+		}
+		// Need to find matching list in results
+		if i := findQSliceForSub(qr[0], results.qsubs); i >= 0 {
+			results.qsubs[i] = append(results.qsubs[i], qr...)
+		} else {
+			// Copy so later removals from the node don't alter held results.
+			results.qsubs = append(results.qsubs, append([]*subscription(nil), qr...))
+		}
+	}
+}
+
+// We do not use a map here since we want iteration to be fast when
+// processing publishes in the client readLoop. So we need to walk
+// sequentially for now.
+func findQSliceForSub(sub *subscription, qsl [][]*subscription) int {
+	if sub.queue == nil {
+		return -1
+	}
+	for i, qr := range qsl {
+		if len(qr) > 0 && bytes.Equal(sub.queue, qr[0].queue) {
+			return i
+		}
+	}
+	return -1
+}
+
+// lnt is used to track descent into levels for a removal for pruning.
+type lnt struct {
+	l *level
+	n *node
+	t string
+}
+
+// Remove will remove a subscription.
+func (s *Sublist) Remove(sub *subscription) error {
+	subject := string(sub.subject)
+	tsa := [32]string{}
+	tokens := tokenizeSubject(tsa[:0], subject)
+
+	s.Lock()
+	defer s.Unlock()
+
+	sfwc := false
+	l := s.root
+	var n *node
+
+	// Track levels for pruning
+	var lnts [32]lnt
+	levels := lnts[:0]
+
+	for _, t := range tokens {
+		lt := len(t)
+		if lt == 0 || sfwc {
+			return ErrInvalidSubject
+		}
+		if l == nil {
+			return ErrNotFound
+		}
+		if lt > 1 {
+			n = l.nodes[t]
+		} else {
+			switch t[0] {
+			case pwc:
+				n = l.pwc
+			case fwc:
+				n = l.fwc
+				sfwc = true
+			default:
+				n = l.nodes[t]
+			}
+		}
+		if n != nil {
+			levels = append(levels, lnt{l, n, t})
+			l = n.next
+		} else {
+			l = nil
+		}
+	}
+	if !s.removeFromNode(n, sub) {
+		return ErrNotFound
+	}
+
+	s.count--
+	s.removes++
+
+	// 自底向上剪掉已经为空的节点
+	for i := len(levels) - 1; i >= 0; i-- {
+		l, n, t := levels[i].l, levels[i].n, levels[i].t
+		if n.isEmpty() {
+			l.pruneNode(n, t)
+		}
+	}
+	s.removeFromCache(subject, sub)
+	atomic.AddUint64(&s.genid, 1)
+
+	return nil
+}
+
+// pruneNode is used to prune an empty node from the tree.
+func (l *level) pruneNode(n *node, t string) {
+	if n == nil {
+		return
+	}
+	if n == l.fwc {
+		l.fwc = nil
+	} else if n == l.pwc {
+		l.pwc = nil
+	} else {
+		delete(l.nodes, t)
+	}
+}
+
+// isEmpty will test if the node has any entries. Used
+// in pruning.
+func (n *node) isEmpty() bool {
+	if len(n.psubs) == 0 && len(n.qsubs) == 0 {
+		if n.next == nil || n.next.numNodes() == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the number of nodes for the given level.
+func (l *level) numNodes() int {
+	num := len(l.nodes)
+	if l.pwc != nil {
+		num++
+	}
+	if l.fwc != nil {
+		num++
+	}
+	return num
+}
+
+// Removes a sub from a list.
+func removeSubFromList(sub *subscription, sl []*subscription) ([]*subscription, bool) {
+	for i := 0; i < len(sl); i++ {
+		if sl[i] == sub {
+			last := len(sl) - 1
+			sl[i] = sl[last]
+			sl[last] = nil
+			sl = sl[:last]
+			return shrinkAsNeeded(sl), true
+		}
+	}
+	return sl, false
+}
+
+// Remove the sub for the given node.
+func (s *Sublist) removeFromNode(n *node, sub *subscription) (found bool) {
+	if n == nil {
+		return false
+	}
+	if sub.queue == nil {
+		n.psubs, found = removeSubFromList(sub, n.psubs)
+		return found
+	}
+
+	// We have a queue group subscription here
+	if i := findQSliceForSub(sub, n.qsubs); i >= 0 {
+		n.qsubs[i], found = removeSubFromList(sub, n.qsubs[i])
+		if len(n.qsubs[i]) == 0 {
+			last := len(n.qsubs) - 1
+			n.qsubs[i] = n.qsubs[last]
+			n.qsubs[last] = nil
+			n.qsubs = n.qsubs[:last]
+			if len(n.qsubs) == 0 {
+				n.qsubs = nil
+			}
+		}
+		return found
+	}
+	return false
+}
+
+// Checks if we need to do a resize. This is for very large growth then
+// subsequent return to a more normal size from unsubscribe.
+func shrinkAsNeeded(sl []*subscription) []*subscription {
+	lsl := len(sl)
+	csl := cap(sl)
+	// Don't bother if list not too big
+	if csl <= 8 {
+		return sl
+	}
+	pFree := float32(csl-lsl) / float32(csl)
+	if pFree > 0.50 {
+		return append([]*subscription(nil), sl...)
+	}
+	return sl
+}
+
+// Count returns the number of subscriptions.
+func (s *Sublist) Count() uint32 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.count
+}
+
+// CacheCount returns the number of result sets in the cache.
+func (s *Sublist) CacheCount() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.cache)
+}
+
+// SublistStats are public stats for the sublist
+type SublistStats struct {
+	NumSubs      uint32  `json:"num_subscriptions"`
+	NumCache     uint32  `json:"num_cache"`
+	NumInserts   uint64  `json:"num_inserts"`
+	NumRemoves   uint64  `json:"num_removes"`
+	NumMatches   uint64  `json:"num_matches"`
+	CacheHitRate float64 `json:"cache_hit_rate"`
+	MaxFanout    uint32  `json:"max_fanout"`
+	AvgFanout    float64 `json:"avg_fanout"`
+}
+
+// Stats will return a stats structure for the current state.
+func (s *Sublist) Stats() *SublistStats {
+	s.RLock()
+	defer s.RUnlock()
+
+	st := &SublistStats{}
+	st.NumSubs = s.count
+	st.NumCache = uint32(len(s.cache))
+	st.NumInserts = s.inserts
+	st.NumRemoves = s.removes
+	st.NumMatches = atomic.LoadUint64(&s.matches)
+	if st.NumMatches > 0 {
+		st.CacheHitRate = float64(atomic.LoadUint64(&s.cacheHits)) / float64(st.NumMatches)
+	}
+
+	// whip through cache for fanout stats
+	tot, max := 0, 0
+	for _, r := range s.cache {
+		l := len(r.psubs) + len(r.qsubs)
+		tot += l
+		if l > max {
+			max = l
+		}
+	}
+	st.MaxFanout = uint32(max)
+	if tot > 0 {
+		st.AvgFanout = float64(tot) / float64(len(s.cache))
+	}
+	return st
+}
+
+// subjectIsLiteral returns true if the subject has no wildcard tokens.
+func subjectIsLiteral(subject string) bool {
+	for i, c := range subject {
+		if c == pwc || c == fwc {
+			if (i == 0 || subject[i-1] == btsep) &&
+				(i+1 == len(subject) || subject[i+1] == btsep) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// IsValidSubject returns true if a subject is valid, false otherwise.
+// Subjects may contain wildcards, but '*' and '>' must stand alone as a
+// token and '>' must be the last token.
+func IsValidSubject(subject string) bool {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return false
+	}
+	sfwc := false
+	tokens := strings.Split(subject, tsp)
+	for _, t := range tokens {
+		if len(t) == 0 || sfwc {
+			return false
+		}
+		if len(t) > 1 {
+			// No stray wildcards, e.g. foo.*bar
+			if strings.IndexByte(t, pwc) >= 0 || strings.IndexByte(t, fwc) >= 0 {
+				return false
+			}
+			continue
+		}
+		switch t[0] {
+		case fwc:
+			sfwc = true
+		}
+	}
+	return true
+}
+
+// IsValidLiteralSubject returns true if a subject is valid and literal (no wildcards), false otherwise
+func IsValidLiteralSubject(subject string) bool {
+	if !IsValidSubject(subject) {
+		return false
+	}
+	return subjectIsLiteral(subject)
+}
+
+// SubjectIsSubsetMatch tests if a subject is a subset of a test subject,
+// e.g. foo.bar is a subset of foo.*, and foo.* is a subset of foo.>,
+// but foo.> is not a subset of foo.*.
+func SubjectIsSubsetMatch(subject, test string) bool {
+	tsa := [32]string{}
+	tokens := tokenizeSubject(tsa[:0], subject)
+	tta := [32]string{}
+	tts := tokenizeSubject(tta[:0], test)
+
+	// Walk the test tokens
+	for i, t2 := range tts {
+		if i >= len(tokens) {
+			return false
+		}
+		l := len(t2)
+		if l == 0 {
+			return false
+		}
+		if t2[0] == fwc && l == 1 {
+			return true
+		}
+		t1 := tokens[i]
+		l = len(t1)
+		if l == 0 || t1[0] == fwc && l == 1 {
+			return false
+		}
+		if t1[0] == pwc && l == 1 {
+			// Only a '*' in the test subject can cover a '*'
+			if !(t2[0] == pwc && len(t2) == 1) {
+				return false
+			}
+			continue
+		}
+		if !(t2[0] == pwc && len(t2) == 1) && t1 != t2 {
+			return false
+		}
+	}
+	return len(tokens) == len(tts)
+}
+
+// matchLiteral is used to test literal subjects, those that do not have any
+// wildcards, with a target subject. This is used in the cache layer.
+func matchLiteral(literal, subject string) bool {
+	li := 0
+	ll := len(literal)
+	for i := 0; i < len(subject); i++ {
+		if li >= ll {
+			return false
+		}
+		b := subject[i]
+		switch b {
+		case pwc:
+			// Skip token in literal
+			for {
+				if li >= ll || literal[li] == btsep {
+					li--
+					break
+				}
+				li++
+			}
+		case fwc:
+			return true
+		default:
+			if b != literal[li] {
+				return false
+			}
+		}
+		li++
+	}
+	// Make sure we have processed all of the literal's chars..
+	return li >= ll
 }
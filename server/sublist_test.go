@@ -0,0 +1,519 @@
+package server
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func verifyCount(s *Sublist, count uint32, t *testing.T) {
+	if s.Count() != count {
+		stackFatalf(t, "Count is %d, should be %d", s.Count(), count)
+	}
+}
+
+func verifyLen(r []*subscription, l int, t *testing.T) {
+	if len(r) != l {
+		stackFatalf(t, "Results len is %d, should be %d", len(r), l)
+	}
+}
+
+func verifyQLen(r [][]*subscription, l int, t *testing.T) {
+	if len(r) != l {
+		stackFatalf(t, "Queue Results len is %d, should be %d", len(r), l)
+	}
+}
+
+func verifyMember(r []*subscription, val *subscription, t *testing.T) {
+	for _, v := range r {
+		if v == nil {
+			continue
+		}
+		if v == val {
+			return
+		}
+	}
+	stackFatalf(t, "Subscription (%p) for [%s : %s] not found in results", val, val.subject, val.queue)
+}
+
+func stackFatalf(t *testing.T, f string, args ...interface{}) {
+	_, file, line, ok := runtime.Caller(2)
+	if ok {
+		f = "%s:%d: " + f
+		args = append([]interface{}{file, line}, args...)
+	}
+	t.Fatalf(f, args...)
+}
+
+// Helpers to generate test subscriptions.
+func newSub(subject string) *subscription {
+	return &subscription{subject: []byte(subject)}
+}
+
+func newQSub(subject, queue string) *subscription {
+	return &subscription{subject: []byte(subject), queue: []byte(queue)}
+}
+
+func TestSublistInit(t *testing.T) {
+	s := NewSubList()
+	verifyCount(s, 0, t)
+}
+
+func TestSublistInsertCount(t *testing.T) {
+	s := NewSubList()
+	s.Insert(newSub("foo"))
+	s.Insert(newSub("bar"))
+	s.Insert(newSub("foo.bar"))
+	verifyCount(s, 3, t)
+}
+
+func TestSublistSimple(t *testing.T) {
+	s := NewSubList()
+	subject := "foo"
+	sub := newSub(subject)
+	s.Insert(sub)
+	r := s.Match(subject)
+	verifyLen(r.psubs, 1, t)
+	verifyMember(r.psubs, sub, t)
+}
+
+func TestSublistSimpleMultiTokens(t *testing.T) {
+	s := NewSubList()
+	subject := "foo.bar.baz"
+	sub := newSub(subject)
+	s.Insert(sub)
+	r := s.Match(subject)
+	verifyLen(r.psubs, 1, t)
+	verifyMember(r.psubs, sub, t)
+}
+
+func TestSublistPartialWildcard(t *testing.T) {
+	s := NewSubList()
+	lsub := newSub("a.b.c")
+	psub := newSub("a.*.c")
+	s.Insert(lsub)
+	s.Insert(psub)
+	r := s.Match("a.b.c")
+	verifyLen(r.psubs, 2, t)
+	verifyMember(r.psubs, lsub, t)
+	verifyMember(r.psubs, psub, t)
+}
+
+func TestSublistPartialWildcardAtEnd(t *testing.T) {
+	s := NewSubList()
+	lsub := newSub("a.b.c")
+	psub := newSub("a.b.*")
+	s.Insert(lsub)
+	s.Insert(psub)
+	r := s.Match("a.b.c")
+	verifyLen(r.psubs, 2, t)
+	verifyMember(r.psubs, lsub, t)
+	verifyMember(r.psubs, psub, t)
+}
+
+func TestSublistFullWildcard(t *testing.T) {
+	s := NewSubList()
+	lsub := newSub("a.b.c")
+	fsub := newSub("a.>")
+	s.Insert(lsub)
+	s.Insert(fsub)
+	r := s.Match("a.b.c")
+	verifyLen(r.psubs, 2, t)
+	verifyMember(r.psubs, lsub, t)
+	verifyMember(r.psubs, fsub, t)
+
+	// '>' needs at least one token to match.
+	r = s.Match("a")
+	verifyLen(r.psubs, 0, t)
+}
+
+func TestSublistRemove(t *testing.T) {
+	s := NewSubList()
+	subject := "a.b.c.d"
+	sub := newSub(subject)
+	s.Insert(sub)
+	verifyCount(s, 1, t)
+	r := s.Match(subject)
+	verifyLen(r.psubs, 1, t)
+	s.Remove(newSub("a.b.c"))
+	verifyCount(s, 1, t)
+	s.Remove(sub)
+	verifyCount(s, 0, t)
+	r = s.Match(subject)
+	verifyLen(r.psubs, 0, t)
+}
+
+func TestSublistRemoveWildcard(t *testing.T) {
+	s := NewSubList()
+	subject := "a.b.c.d"
+	sub := newSub(subject)
+	psub := newSub("a.b.*.d")
+	fsub := newSub("a.b.>")
+	s.Insert(sub)
+	s.Insert(psub)
+	s.Insert(fsub)
+	verifyCount(s, 3, t)
+	r := s.Match(subject)
+	verifyLen(r.psubs, 3, t)
+	s.Remove(sub)
+	verifyCount(s, 2, t)
+	s.Remove(fsub)
+	verifyCount(s, 1, t)
+	s.Remove(psub)
+	verifyCount(s, 0, t)
+	r = s.Match(subject)
+	verifyLen(r.psubs, 0, t)
+}
+
+func TestSublistRemoveCleanup(t *testing.T) {
+	s := NewSubList()
+	literal := "a.b.c.d.e.f"
+	depth := len(tokenizeSubject(nil, literal))
+	sub := newSub(literal)
+	verifyNumLevels(s, 0, t)
+	s.Insert(sub)
+	verifyNumLevels(s, depth, t)
+	s.Remove(sub)
+	verifyNumLevels(s, 0, t)
+}
+
+func TestSublistRemoveCleanupWildcards(t *testing.T) {
+	s := NewSubList()
+	subject := "a.b.*.d.e.>"
+	depth := len(tokenizeSubject(nil, subject))
+	sub := newSub(subject)
+	verifyNumLevels(s, 0, t)
+	s.Insert(sub)
+	verifyNumLevels(s, depth, t)
+	s.Remove(sub)
+	verifyNumLevels(s, 0, t)
+}
+
+func TestSublistInvalidSubjectsInsert(t *testing.T) {
+	s := NewSubList()
+
+	// Insert, or subscribtions, can have wildcards, but not empty tokens,
+	// and can not have a FWC that is not the terminal token.
+
+	// beginning empty token
+	if err := s.Insert(newSub(".foo")); err != ErrInvalidSubject {
+		t.Fatal("Expected invalid subject error")
+	}
+
+	// trailing empty token
+	if err := s.Insert(newSub("foo.")); err != ErrInvalidSubject {
+		t.Fatal("Expected invalid subject error")
+	}
+	// empty middle token
+	if err := s.Insert(newSub("foo..bar")); err != ErrInvalidSubject {
+		t.Fatal("Expected invalid subject error")
+	}
+	// empty middle token #2
+	if err := s.Insert(newSub("foo.bar..baz")); err != ErrInvalidSubject {
+		t.Fatal("Expected invalid subject error")
+	}
+	// fwc not terminal
+	if err := s.Insert(newSub("foo.>.bar")); err != ErrInvalidSubject {
+		t.Fatal("Expected invalid subject error")
+	}
+}
+
+func TestSublistCache(t *testing.T) {
+	s := NewSubList()
+
+	// Test add a remove logistics
+	subject := "a.b.c.d"
+	sub := newSub(subject)
+	psub := newSub("a.b.*.d")
+	fsub := newSub("a.b.>")
+	s.Insert(sub)
+	r := s.Match(subject)
+	verifyLen(r.psubs, 1, t)
+	s.Insert(psub)
+	s.Insert(fsub)
+	verifyCount(s, 3, t)
+	r = s.Match(subject)
+	verifyLen(r.psubs, 3, t)
+	s.Remove(sub)
+	verifyCount(s, 2, t)
+	s.Remove(fsub)
+	verifyCount(s, 1, t)
+	s.Remove(psub)
+	verifyCount(s, 0, t)
+
+	// Check that cache is now empty
+	if cc := s.CacheCount(); cc != 0 {
+		t.Fatalf("Cache should be zero, got %d\n", cc)
+	}
+
+	r = s.Match(subject)
+	verifyLen(r.psubs, 0, t)
+
+	// A literal insert updates the matching cache entry in place.
+	s.Insert(sub)
+	if cc := s.CacheCount(); cc != 1 {
+		t.Fatalf("Cache should be 1, got %d\n", cc)
+	}
+	r = s.Match(subject)
+	verifyLen(r.psubs, 1, t)
+
+	// A wildcard insert invalidates the matching cache entries.
+	s.Match("a.b.x.d")
+	s.Match("z")
+	s.Insert(psub)
+	if cc := s.CacheCount(); cc != 1 {
+		t.Fatalf("Cache should be 1, got %d\n", cc)
+	}
+	r = s.Match(subject)
+	verifyLen(r.psubs, 2, t)
+
+	for i := 0; i < 2*slCacheMax; i++ {
+		s.Match(fmt.Sprintf("foo-%d\n", i))
+	}
+	if cc := s.CacheCount(); cc > slCacheMax {
+		t.Fatalf("Cache should be constrained by cacheMax, got %d for current count\n", cc)
+	}
+}
+
+func TestSublistGenID(t *testing.T) {
+	s := NewSubList()
+	sub := newSub("foo.bar")
+	genid := s.genid
+	s.Insert(sub)
+	if s.genid == genid {
+		t.Fatal("Expected genid to change on insert")
+	}
+	genid = s.genid
+	s.Match("foo.bar")
+	if s.genid != genid {
+		t.Fatal("Expected genid to not change on match")
+	}
+	s.Remove(sub)
+	if s.genid == genid {
+		t.Fatal("Expected genid to change on remove")
+	}
+}
+
+func TestSublistBasicQueueResults(t *testing.T) {
+	s := NewSubList()
+
+	// Test some basics
+	subject := "foo"
+	sub := newSub(subject)
+	sub1 := newQSub(subject, "bar")
+	sub2 := newQSub(subject, "baz")
+
+	s.Insert(sub1)
+	r := s.Match(subject)
+	verifyLen(r.psubs, 0, t)
+	verifyQLen(r.qsubs, 1, t)
+	verifyLen(r.qsubs[0], 1, t)
+	verifyMember(r.qsubs[0], sub1, t)
+
+	s.Insert(sub2)
+	r = s.Match(subject)
+	verifyLen(r.psubs, 0, t)
+	verifyQLen(r.qsubs, 2, t)
+	verifyLen(r.qsubs[0], 1, t)
+	verifyLen(r.qsubs[1], 1, t)
+	verifyMember(r.qsubs[0], sub1, t)
+	verifyMember(r.qsubs[1], sub2, t)
+
+	s.Insert(sub)
+	r = s.Match(subject)
+	verifyLen(r.psubs, 1, t)
+	verifyQLen(r.qsubs, 2, t)
+
+	sub3 := newQSub(subject, "bar")
+	sub4 := newQSub(subject, "baz")
+
+	s.Insert(sub3)
+	s.Insert(sub4)
+
+	r = s.Match(subject)
+	verifyLen(r.psubs, 1, t)
+	verifyQLen(r.qsubs, 2, t)
+	verifyLen(r.qsubs[0], 2, t)
+	verifyLen(r.qsubs[1], 2, t)
+	verifyMember(r.qsubs[0], sub1, t)
+	verifyMember(r.qsubs[0], sub3, t)
+	verifyMember(r.qsubs[1], sub2, t)
+	verifyMember(r.qsubs[1], sub4, t)
+
+	// Now removal
+	s.Remove(sub)
+
+	r = s.Match(subject)
+	verifyLen(r.psubs, 0, t)
+	verifyQLen(r.qsubs, 2, t)
+
+	s.Remove(sub1)
+	r = s.Match(subject)
+	verifyQLen(r.qsubs, 2, t)
+	verifyLen(r.qsubs[0], 1, t)
+	verifyLen(r.qsubs[1], 2, t)
+	verifyMember(r.qsubs[0], sub3, t)
+
+	s.Remove(sub3) // Last one
+	r = s.Match(subject)
+	verifyQLen(r.qsubs, 1, t)
+	verifyLen(r.qsubs[0], 2, t)
+	verifyMember(r.qsubs[0], sub2, t)
+	verifyMember(r.qsubs[0], sub4, t)
+
+	s.Remove(sub2)
+	s.Remove(sub4)
+	r = s.Match(subject)
+	verifyLen(r.psubs, 0, t)
+	verifyQLen(r.qsubs, 0, t)
+}
+
+func TestSublistStats(t *testing.T) {
+	s := NewSubList()
+	s.Insert(newSub("foo"))
+	s.Insert(newSub("foo"))
+	s.Insert(newQSub("foo", "bar"))
+	s.Insert(newSub("bar"))
+
+	s.Match("foo")
+	s.Match("foo")
+	s.Match("bar")
+	s.Match("baz")
+
+	st := s.Stats()
+	if st.NumSubs != 4 {
+		t.Fatalf("Wrong stats for NumSubs: %d vs %d\n", st.NumSubs, 4)
+	}
+	if st.NumInserts != 4 {
+		t.Fatalf("Wrong stats for NumInserts: %d vs %d\n", st.NumInserts, 4)
+	}
+	if st.NumCache != 3 {
+		t.Fatalf("Wrong stats for NumCache: %d vs %d\n", st.NumCache, 3)
+	}
+	if st.NumMatches != 4 {
+		t.Fatalf("Wrong stats for NumMatches: %d vs %d\n", st.NumMatches, 4)
+	}
+	if st.CacheHitRate != 0.25 {
+		t.Fatalf("Wrong stats for CacheHitRate: %.2f vs %.2f\n", st.CacheHitRate, 0.25)
+	}
+	if st.MaxFanout != 3 {
+		t.Fatalf("Wrong stats for MaxFanout: %d vs %d\n", st.MaxFanout, 3)
+	}
+	if st.AvgFanout != 4.0/3.0 {
+		t.Fatalf("Wrong stats for AvgFanout: %.2f vs %.2f\n", st.AvgFanout, 4.0/3.0)
+	}
+}
+
+func TestSublistValidSubjects(t *testing.T) {
+	checkBool := func(b, expected bool, t *testing.T) {
+		if b != expected {
+			stackFatalf(t, "Expected %v, but got %v\n", expected, b)
+		}
+	}
+	checkBool(IsValidSubject("foo"), true, t)
+	checkBool(IsValidSubject("foo.bar"), true, t)
+	checkBool(IsValidSubject("foo.*"), true, t)
+	checkBool(IsValidSubject("foo.*.bar"), true, t)
+	checkBool(IsValidSubject("foo.>"), true, t)
+	checkBool(IsValidSubject(">"), true, t)
+	checkBool(IsValidSubject(""), false, t)
+	checkBool(IsValidSubject("."), false, t)
+	checkBool(IsValidSubject(".foo"), false, t)
+	checkBool(IsValidSubject("foo."), false, t)
+	checkBool(IsValidSubject("foo..bar"), false, t)
+	checkBool(IsValidSubject("foo.*bar"), false, t)
+	checkBool(IsValidSubject("foo.bar>"), false, t)
+	checkBool(IsValidSubject("foo.>.bar"), false, t)
+	checkBool(IsValidSubject("foo bar"), false, t)
+
+	checkBool(IsValidLiteralSubject("foo"), true, t)
+	checkBool(IsValidLiteralSubject("foo.bar.baz"), true, t)
+	checkBool(IsValidLiteralSubject("foo.*"), false, t)
+	checkBool(IsValidLiteralSubject("foo.>"), false, t)
+	checkBool(IsValidLiteralSubject("foo.*bar"), false, t)
+	checkBool(IsValidLiteralSubject("foo..bar"), false, t)
+}
+
+func TestSublistSubjectIsSubsetMatch(t *testing.T) {
+	checkBool := func(b, expected bool, t *testing.T) {
+		if b != expected {
+			stackFatalf(t, "Expected %v, but got %v\n", expected, b)
+		}
+	}
+	checkBool(SubjectIsSubsetMatch("foo.bar", "foo.bar"), true, t)
+	checkBool(SubjectIsSubsetMatch("foo.bar", "foo.*"), true, t)
+	checkBool(SubjectIsSubsetMatch("foo.bar", "foo.>"), true, t)
+	checkBool(SubjectIsSubsetMatch("foo.bar.*", "foo.>"), true, t)
+	checkBool(SubjectIsSubsetMatch("foo.*", "foo.*"), true, t)
+	checkBool(SubjectIsSubsetMatch("foo.*", "foo.>"), true, t)
+	checkBool(SubjectIsSubsetMatch("foo.>", "foo.>"), true, t)
+	checkBool(SubjectIsSubsetMatch("foo.>", ">"), true, t)
+	checkBool(SubjectIsSubsetMatch(">", "foo.>"), false, t)
+	checkBool(SubjectIsSubsetMatch("foo.>", "foo.*"), false, t)
+	checkBool(SubjectIsSubsetMatch("foo.*", "foo.bar"), false, t)
+	checkBool(SubjectIsSubsetMatch("foo", "foo.>"), false, t)
+	checkBool(SubjectIsSubsetMatch("foo.bar.baz", "foo.*"), false, t)
+	checkBool(SubjectIsSubsetMatch("bar.baz", "foo.>"), false, t)
+}
+
+func TestSublistMatchLiterals(t *testing.T) {
+	checkBool := func(b, expected bool, t *testing.T) {
+		if b != expected {
+			stackFatalf(t, "Expected %v, but got %v\n", expected, b)
+		}
+	}
+	checkBool(matchLiteral("foo", "foo"), true, t)
+	checkBool(matchLiteral("foo", "bar"), false, t)
+	checkBool(matchLiteral("foo", "*"), true, t)
+	checkBool(matchLiteral("foo", ">"), true, t)
+	checkBool(matchLiteral("foo.bar", ">"), true, t)
+	checkBool(matchLiteral("foo.bar", "foo.>"), true, t)
+	checkBool(matchLiteral("foo.bar", "bar.>"), false, t)
+	checkBool(matchLiteral("stats.test.22", "stats.>"), true, t)
+	checkBool(matchLiteral("stats.test.22", "stats.*.*"), true, t)
+	checkBool(matchLiteral("foo.bar", "foo"), false, t)
+	checkBool(matchLiteral("stats.test.foos", "stats.test.foos"), true, t)
+	checkBool(matchLiteral("stats.test.foos", "stats.test.foo"), false, t)
+}
+
+// Return the depth of the first level in the trie.
+func verifyNumLevels(s *Sublist, expected int, t *testing.T) {
+	dl := visitLevel(s.root, 0)
+	if dl != expected {
+		stackFatalf(t, "NumLevels is %d, should be %d", dl, expected)
+	}
+}
+
+// visitLevel is used to descend the Sublist tree structure
+// recursively.
+func visitLevel(l *level, depth int) int {
+	if l == nil || l.numNodes() == 0 {
+		return depth
+	}
+
+	depth++
+	maxDepth := depth
+
+	for _, n := range l.nodes {
+		if n == nil {
+			continue
+		}
+		newDepth := visitLevel(n.next, depth)
+		if newDepth > maxDepth {
+			maxDepth = newDepth
+		}
+	}
+	if l.pwc != nil {
+		pwcDepth := visitLevel(l.pwc.next, depth)
+		if pwcDepth > maxDepth {
+			maxDepth = pwcDepth
+		}
+	}
+	if l.fwc != nil {
+		fwcDepth := visitLevel(l.fwc.next, depth)
+		if fwcDepth > maxDepth {
+			maxDepth = fwcDepth
+		}
+	}
+	return maxDepth
+}
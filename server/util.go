@@ -0,0 +1,50 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Ascii numbers 0-9
+const (
+	asciiZero = 48
+	asciiNine = 57
+)
+
+// parseSize expects decimal positive numbers. We
+// return -1 to signal error
+func parseSize(d []byte) (n int) {
+	// 限制位数，避免过长的数字溢出int变成一个很小或负的长度
+	const maxParseSizeLen = 9 //999M
+
+	l := len(d)
+	if l == 0 || l > maxParseSizeLen {
+		return -1
+	}
+	for _, dec := range d {
+		if dec < asciiZero || dec > asciiNine {
+			return -1
+		}
+		n = n*10 + (int(dec) - asciiZero)
+	}
+	return n
+}
+
+// secondsToDuration converts a (possibly fractional) number of
+// seconds from the options into a time.Duration.
+func secondsToDuration(seconds float64) time.Duration {
+	ttl := seconds * float64(time.Second)
+	return time.Duration(ttl)
+}
+
+// genID generates a random unique ID for the server.
+func genID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		PrintAndDie(fmt.Sprintf("Could not generate server id: %v", err))
+	}
+	return strings.ToUpper(hex.EncodeToString(b[:]))
+}
@@ -0,0 +1,23 @@
+package server
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int
+	}{
+		{"", -1},
+		{"0", 0},
+		{"22", 22},
+		{"999999999", 999999999},
+		{"1000000000", -1},
+		{"99999999999999999999", -1},
+		{"12a", -1},
+		{"-1", -1},
+	} {
+		if n := parseSize([]byte(tc.in)); n != tc.want {
+			t.Fatalf("parseSize(%q): expected %d, got %d", tc.in, tc.want, n)
+		}
+	}
+}